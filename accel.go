@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// --- Internal Redirects ---
+
+// accelHeaders are the upstream's headers which still apply to the file served in its place
+var accelHeaders = []string{"Cache-Control", "Content-Disposition", "Content-Type", "Expires"}
+
+// AccelRedirect is returned from ModifyResponse when the upstream asks for a file to be served in its place (like
+// nginx's X-Accel-Redirect), so the Proxy's ErrorHandler can serve it to the client.
+type AccelRedirect struct {
+	Path   string
+	Header http.Header
+}
+
+func (accel *AccelRedirect) Error() string {
+	return "internal redirect to " + accel.Path
+}
+
+// checkAccelRedirect turns a response carrying the trigger header into an AccelRedirect
+func checkAccelRedirect(response *http.Response, trigger string) error {
+	path := response.Header.Get(trigger)
+	if path == "" {
+		return nil
+	}
+	response.Body.Close()
+
+	header := http.Header{}
+	for _, name := range accelHeaders {
+		if values, ok := response.Header[name]; ok {
+			header[name] = values
+		}
+	}
+	return &AccelRedirect{Path: path, Header: header}
+}
+
+// Serve sends the file from root. Opening it through http.Dir keeps it inside root, and ServeContent handles
+// ranges and conditional requests just as for a Static host.
+func (accel *AccelRedirect) Serve(writer http.ResponseWriter, request *http.Request, root string) {
+	dispatchf(request, "Internal Redirect(%v) %v %v\n", request.Host, root, accel.Path)
+
+	file, err := http.Dir(root).Open(accel.Path)
+	if err != nil {
+		log.Printf("Internal Redirect(%v) %v\n", request.Host, err)
+		http.NotFound(writer, request)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(writer, request)
+		return
+	}
+
+	for name, values := range accel.Header {
+		writer.Header()[name] = values
+	}
+	http.ServeContent(writer, request, info.Name(), info.ModTime(), file)
+}
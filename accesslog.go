@@ -0,0 +1,265 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Access Log ---
+
+// accessLogFlushInterval is how often a gzipped access log is flushed, which is the most that's lost on a crash
+const accessLogFlushInterval = 5 * time.Second
+
+// AccessLog writes a line for every request to the access_log file, gzipped if Compress is on. Appending to a
+// gzipped log each time it's opened adds another gzip member, which gunzip and zcat read straight through.
+type AccessLog struct {
+	Path     string
+	Compress bool
+
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+}
+
+// accessLog is the access log, if there is one
+var accessLog *AccessLog
+
+func openAccessLog(path string, compress bool) (*AccessLog, error) {
+	accessLog := &AccessLog{Path: path, Compress: compress}
+	if err := accessLog.open(); err != nil {
+		return nil, err
+	}
+	if compress {
+		go accessLog.flushEvery(accessLogFlushInterval)
+	}
+	return accessLog, nil
+}
+
+func (l *AccessLog) open() error {
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	if l.Compress {
+		l.gz = gzip.NewWriter(file)
+	}
+	return nil
+}
+
+// close finishes off the file, including the gzip trailer, so nothing written is lost
+func (l *AccessLog) close() error {
+	if l.file == nil {
+		return nil
+	}
+	if l.gz != nil {
+		if err := l.gz.Close(); err != nil {
+			l.file.Close()
+			return err
+		}
+		l.gz = nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *AccessLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	if l.gz != nil {
+		return l.gz.Write(p)
+	}
+	return l.file.Write(p)
+}
+
+// Reopen closes the file and opens it again by name, so a log which has been rotated away is started afresh
+func (l *AccessLog) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.close(); err != nil {
+		log.Println("Access log:", err)
+	}
+	return l.open()
+}
+
+// Close flushes and closes the file, after which nothing more is logged
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.close()
+}
+
+// flushEvery flushes the gzip writer every interval, so lines don't sit in its buffer for long on a quiet server
+func (l *AccessLog) flushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mu.Lock()
+		if l.gz != nil {
+			if err := l.gz.Flush(); err != nil {
+				log.Println("Access log:", err)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Log writes the request's line, in the combined log format with the host in front and the time taken on the end,
+// as JSON when log_format is json, or as access_log_format has it when that's set
+func (l *AccessLog) Log(request *http.Request, status int, size int64, took time.Duration, upstream *time.Duration) {
+	if format := settings.AccessLogFormat; format != nil {
+		entry := &accessLogEntry{request: request, status: status, size: size, took: took, upstream: upstream, at: time.Now()}
+		if _, err := io.WriteString(l, format.render(entry)); err != nil && err != os.ErrClosed {
+			log.Println("Access log:", err)
+		}
+		return
+	}
+
+	remote, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		remote = request.RemoteAddr
+	}
+	uri := logURI(request)
+
+	if jsonLogging {
+		err = writeJSON(l, map[string]interface{}{
+			"host":       request.Host,
+			"remote":     remote,
+			"method":     request.Method,
+			"uri":        uri,
+			"proto":      request.Proto,
+			"status":     status,
+			"size":       size,
+			"referer":    request.Referer(),
+			"user_agent": request.UserAgent(),
+			"took":       took.Seconds(),
+		})
+	} else {
+		if uri == "" {
+			uri = "-"
+		}
+		_, err = fmt.Fprintf(l, "%v %v - - [%v] \"%v %v %v\" %d %d %q %q %.3f\n", request.Host, remote,
+			time.Now().Format("02/Jan/2006:15:04:05 -0700"), request.Method, uri, request.Proto, status, size,
+			orDash(request.Referer()), orDash(request.UserAgent()), took.Seconds())
+	}
+	if err != nil && err != os.ErrClosed {
+		log.Println("Access log:", err)
+	}
+}
+
+// orDash is the value, or "-" if it's empty, as access logs have it
+func orDash(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "-"
+	}
+	return value
+}
+
+// accessLogged logs every request the handler serves to the access log
+func accessLogged(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		statusWriter := &statusWriter{ResponseWriter: writer}
+		handler.ServeHTTP(statusWriter, request)
+		if statusWriter.status == 0 {
+			statusWriter.status = http.StatusOK
+		}
+		// anything other than a 2xx is always logged, however few of the rest are
+		if statusWriter.status < 300 {
+			if rules.Load().Quiet[request.Host] {
+				return
+			}
+			if sample := statusWriter.sample; sample != nil && rand.Float64() >= *sample {
+				return
+			}
+		}
+		accessLog.Log(request, statusWriter.status, statusWriter.size, time.Since(start), statusWriter.upstream)
+	})
+}
+
+// statusWriter notes the status and size of the response as it goes out
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+	// sample is the rule's access_log_sample, once a rule has taken the request
+	sample *float64
+	// upstream is how long the upstream took, when the request was proxied
+	upstream *time.Duration
+}
+
+// findStatusWriter digs the access log's statusWriter out from under any other writers, or gives nil if there's no
+// access log
+func findStatusWriter(writer http.ResponseWriter) *statusWriter {
+	for {
+		switch w := writer.(type) {
+		case *statusWriter:
+			return w
+		case interface{ Unwrap() http.ResponseWriter }:
+			writer = w.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := readFrom(w.ResponseWriter, src)
+	w.size += n
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// closeAccessLogOnSignal closes the access log on SIGTERM or SIGINT when we aren't draining, which would otherwise
+// stop us with the end of a gzipped log still unwritten, then exits as the signal would have
+func closeAccessLogOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Printf("Received %v, stopping\n", sig)
+	if err := accessLog.Close(); err != nil {
+		log.Println("Access log:", err)
+	}
+	os.Exit(128 + int(sig.(syscall.Signal)))
+}
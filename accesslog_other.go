@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "log"
+
+// reopenAccessLogOnSignal can't be told to reopen the access log on this platform, which has no SIGUSR1, so the log
+// can only be rotated by copying and truncating it
+func reopenAccessLogOnSignal() {
+	log.Println("Warning: no SIGUSR1 to reopen the access log with on this platform")
+}
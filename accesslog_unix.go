@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reopenAccessLogOnSignal reopens the access log each time we get a SIGUSR1, once logrotate has moved it away
+func reopenAccessLogOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		log.Println("Reopening", accessLog.Path)
+		if err := accessLog.Reopen(); err != nil {
+			log.Println("Access log:", err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Certificates ---
+
+// Certificates are the key pairs loaded from cert_dir, by each name they're for, with Default served to clients
+// asking for a name none of them have.
+type Certificates struct {
+	ByName  map[string]*tls.Certificate
+	Default *tls.Certificate
+}
+
+// certificates holds the Certificates in use, which are swapped whole when cert_dir is reloaded
+var certificates atomic.Pointer[Certificates]
+
+// loadCertificates loads every name.crt in dir along with its name.key, returning every problem found. Each is
+// served for the names (including wildcards) in its SANs, or its common name if it has none. Files are loaded in
+// name order and the first for any name wins. defaultName, if set, is the name of the pair (without .crt) to use
+// when nothing else matches.
+func loadCertificates(dir, defaultName string) (*Certificates, []error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, []error{&ConfigError{File: dir, Err: err}}
+	}
+
+	var errs []error
+	certs := &Certificates{ByName: make(map[string]*tls.Certificate)}
+	for _, file := range files {
+		pair, err := tls.LoadX509KeyPair(file, strings.TrimSuffix(file, ".crt")+".key")
+		if err != nil {
+			errs = append(errs, &ConfigError{File: file, Err: err})
+			continue
+		}
+		names := pair.Leaf.DNSNames
+		if len(names) == 0 && pair.Leaf.Subject.CommonName != "" {
+			names = []string{pair.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := certs.ByName[name]; ok {
+				log.Printf("Warning: %v is also for %v, which an earlier certificate has\n", file, name)
+				continue
+			}
+			certs.ByName[name] = &pair
+		}
+		if strings.TrimSuffix(filepath.Base(file), ".crt") == defaultName {
+			certs.Default = &pair
+		}
+	}
+	if defaultName != "" && certs.Default == nil {
+		errs = append(errs, &ConfigError{File: settingsFile, Key: "default_cert", Err: fmt.Errorf("no %v.crt in %v", defaultName, dir)})
+	}
+	return certs, errs
+}
+
+// getCertificate picks the certificate for the name the client asked for, trying a wildcard for its parent domain
+// when there's nothing exact
+func getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := certificates.Load()
+	name := strings.ToLower(hello.ServerName)
+	if cert, ok := certs.ByName[name]; ok {
+		return cert, nil
+	}
+	if dot := strings.IndexByte(name, '.'); dot >= 0 {
+		if cert, ok := certs.ByName["*"+name[dot:]]; ok {
+			return cert, nil
+		}
+	}
+	if certs.Default != nil {
+		return certs.Default, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// tlsVersions are the TLS versions tls_min_version and tls_max_version may name
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion reads a TLS version, such as "1.2"
+func parseTLSVersion(value string) (uint16, error) {
+	version, ok := tlsVersions[value]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, should be 1.0, 1.1, 1.2 or 1.3", value)
+	}
+	return version, nil
+}
+
+// parseCipherSuites reads a comma separated list of cipher suites by their Go names, e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3's suites can't be chosen, so naming one is a mistake.
+func parseCipherSuites(value string) ([]uint16, error) {
+	known := make(map[string]*tls.CipherSuite)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		suite, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("%v is a TLS 1.3 suite, which are always on", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// tlsConfig is the config for the HTTPS listener, from the tls_* settings
+func tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     settings.TLSMinVersion,
+		MaxVersion:     settings.TLSMaxVersion,
+		CipherSuites:   settings.TLSCiphers,
+	}
+}
+
+// reloadCertificates loads cert_dir again so renewed certificates are picked up, keeping the current ones if
+// there's a problem
+func reloadCertificates() {
+	log.Println("Reloading", settings.CertDir)
+	certs, errs := loadCertificates(settings.CertDir, settings.DefaultCert)
+	if len(errs) > 0 {
+		log.Printf("Not reloading certificates, found %d problem(s):\n", len(errs))
+		for _, err := range errs {
+			log.Println("  ", err)
+		}
+		return
+	}
+	certificates.Store(certs)
+	log.Printf("Loaded %d certificate names\n", len(certs.ByName))
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// --- Compression ---
+
+// minCompressSize is the smallest response worth compressing
+const minCompressSize = 1024
+
+// compressibleTypes are the content types (or prefixes of) which are worth compressing, unless compress_types says
+// otherwise
+var compressibleTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+// CompressionLevel is the level used by each encoding, since they don't share a scale.
+type CompressionLevel struct {
+	Gzip   int
+	Brotli int
+}
+
+// Compression is how a host compresses its responses.
+type Compression struct {
+	Gzip   bool
+	Brotli bool
+	Level  CompressionLevel
+	// Types are the content types (or prefixes of) to compress
+	Types []string
+}
+
+// parseCompressTypes reads a comma separated list of content types, or prefixes of them such as "text/", giving
+// the built in compressibleTypes when there are none
+func parseCompressTypes(value string) []string {
+	var types []string
+	for _, typ := range strings.Split(value, ",") {
+		if typ = strings.ToLower(strings.TrimSpace(typ)); typ != "" {
+			types = append(types, typ)
+		}
+	}
+	if len(types) == 0 {
+		return compressibleTypes
+	}
+	return types
+}
+
+// defaultCompressionLevel is each encoding's own default
+var defaultCompressionLevel = CompressionLevel{gzip.DefaultCompression, brotli.DefaultCompression}
+
+// parseCompressionLevel reads a compression_level of 1-9, "default", "best" or "fast"
+func parseCompressionLevel(value string) (CompressionLevel, error) {
+	switch value {
+	case "", "default":
+		return defaultCompressionLevel, nil
+	case "best":
+		return CompressionLevel{gzip.BestCompression, brotli.BestCompression}, nil
+	case "fast":
+		return CompressionLevel{gzip.BestSpeed, brotli.BestSpeed}, nil
+	}
+	level, err := strconv.Atoi(value)
+	if err != nil || level < gzip.BestSpeed || level > gzip.BestCompression {
+		return CompressionLevel{}, fmt.Errorf("invalid compression_level %q, should be 1-9, default, best or fast", value)
+	}
+	return CompressionLevel{level, level}, nil
+}
+
+// acceptsEncoding says whether the client will take a response with this content coding. As in RFC 9110 12.5.3,
+// codings are matched case-insensitively, one with a q of 0 is refused, and the client's "*" stands for any coding
+// it doesn't name.
+func acceptsEncoding(request *http.Request, coding string) bool {
+	named, wildcard := -1.0, -1.0
+	for _, accepted := range strings.Split(strings.Join(request.Header.Values("Accept-Encoding"), ","), ",") {
+		params := strings.Split(accepted, ";")
+		quality := 1.0
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				var err error
+				if quality, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+					// a q we can't read isn't taken as a yes
+					quality = 0
+				}
+			}
+		}
+		switch name := strings.TrimSpace(params[0]); {
+		case strings.EqualFold(name, coding):
+			named = quality
+		case name == "*":
+			wildcard = quality
+		}
+	}
+	if named >= 0 {
+		return named > 0
+	}
+	return wildcard > 0
+}
+
+// encoder is what both gzip.Writer and brotli.Writer look like
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter returns a writer for the best encoding both we and the client can do, preferring brotli,
+// or nil if there isn't one. An upgrade (e.g. a websocket) is never compressed, as what follows its 101 isn't HTTP.
+func compressWriter(writer http.ResponseWriter, request *http.Request, compression Compression) *compressResponseWriter {
+	if isUpgrade(request.Header) {
+		return nil
+	}
+	if compression.Brotli && acceptsEncoding(request, "br") {
+		return &compressResponseWriter{
+			ResponseWriter: writer,
+			encoding:       "br",
+			types:          compression.Types,
+			newEncoder: func(w io.Writer) encoder {
+				return brotli.NewWriterLevel(w, compression.Level.Brotli)
+			},
+		}
+	}
+	if compression.Gzip && acceptsEncoding(request, "gzip") {
+		return &compressResponseWriter{
+			ResponseWriter: writer,
+			encoding:       "gzip",
+			types:          compression.Types,
+			newEncoder: func(w io.Writer) encoder {
+				gz, _ := gzip.NewWriterLevel(w, compression.Level.Gzip)
+				return gz
+			},
+		}
+	}
+	return nil
+}
+
+// isCompressible says whether a response with this content type is one of the types to compress
+func isCompressible(contentType string, types []string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, typ := range types {
+		if strings.HasPrefix(contentType, typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressResponseWriter holds back the start of a response until it can tell whether it's worth compressing,
+// then either encodes everything or passes it straight through.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding   string
+	newEncoder func(io.Writer) encoder
+	types      []string
+	status     int
+	buf        bytes.Buffer
+	decided    bool
+	enc        encoder
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if code == http.StatusSwitchingProtocols && !w.decided {
+		// the connection is about to be handed over, so nothing more is ours to encode
+		w.decided = true
+		w.status = code
+	}
+	if code >= 100 && code < 200 {
+		// informational responses go straight out
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf.Write(b)
+	if w.buf.Len() >= minCompressSize {
+		w.decide(true)
+	}
+	return len(b), nil
+}
+
+// decide chooses whether to compress (big enough is whether we've seen enough of the body to make it worthwhile)
+// and sends on the header and anything held back so far
+func (w *compressResponseWriter) decide(bigEnough bool) {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	header := w.Header()
+	if header.Get("Content-Type") == "" && w.buf.Len() > 0 {
+		header.Set("Content-Type", http.DetectContentType(w.buf.Bytes()))
+	}
+	// anything already encoded (e.g. gzipped by the upstream) goes through as it is, never compressed twice
+	encoded := header.Get("Content-Encoding") != "" && header.Get("Content-Encoding") != "identity"
+	compressible := !encoded && isCompressible(header.Get("Content-Type"), w.types)
+	if compressible {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	// a range is of the uncompressed body, so compressing one (or offering them once compressed) would garble it
+	partial := w.status == http.StatusPartialContent || header.Get("Content-Range") != ""
+	if compressible && bigEnough && !partial && !isUpgrade(header) && w.status != http.StatusNoContent &&
+		w.status != http.StatusNotModified {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		w.enc = w.newEncoder(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() > 0 {
+		if w.enc != nil {
+			w.enc.Write(w.buf.Bytes())
+		} else {
+			w.ResponseWriter.Write(w.buf.Bytes())
+		}
+		w.buf.Reset()
+	}
+}
+
+// Flush sends what we have so far, so streaming responses keep streaming
+func (w *compressResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close must be called once the handler has finished, to send anything still held back
+func (w *compressResponseWriter) Close() error {
+	if !w.decided {
+		if w.status == 0 {
+			// nothing was written at all, so let the server send its usual empty 200
+			return nil
+		}
+		w.decide(false)
+	}
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCompression = Compression{Gzip: true, Level: defaultCompressionLevel, Types: compressibleTypes}
+
+// echoUpgradeUpstream switches protocols for an Upgrade and then echoes whatever it's sent
+func echoUpgradeUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Upgrade") != "echo" {
+			http.Error(writer, "not an upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, buffered, err := http.NewResponseController(writer).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(buffered, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buffered.Flush()
+		io.Copy(conn, buffered)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestCompressionUpgrade(t *testing.T) {
+	for _, compression := range []*Compression{nil, &testCompression} {
+		rule := &Rule{Handler: testProxy(t, echoUpgradeUpstream(t), ProxyOptions{}), Compression: compression}
+		server := httptest.NewServer(rule)
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a.com\r\nAccept-Encoding: gzip\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("compression %v: got %v, want a 101", compression != nil, response.Status)
+		}
+		if encoding := response.Header.Get("Content-Encoding"); encoding != "" {
+			t.Errorf("compression %v: the 101 is encoded with %v", compression != nil, encoding)
+		}
+		io.WriteString(conn, "ping\n")
+		line, err := reader.ReadString('\n')
+		if err != nil || line != "ping\n" {
+			t.Errorf("compression %v: echoed %q, %v", compression != nil, line, err)
+		}
+	}
+}
+
+func TestCompressionUnwrap(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	compressor := compressWriter(recorder, request, testCompression)
+	if compressor == nil {
+		t.Fatal("no compressor for a client accepting gzip")
+	}
+	if compressor.Unwrap() != recorder {
+		t.Error("Unwrap doesn't give the writer underneath")
+	}
+
+	request.Header.Set("Connection", "keep-alive, Upgrade")
+	if compressWriter(recorder, request, testCompression) != nil {
+		t.Error("an upgrade request got a compressor")
+	}
+}
+
+func TestCompressionCompresses(t *testing.T) {
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain")
+		io.WriteString(writer, strings.Repeat("compress me ", 1000))
+	})
+	server := httptest.NewServer(&Rule{Handler: handler, Compression: &testCompression})
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("Content-Encoding is %q, want gzip", response.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestCompressionLeavesEncodedAlone(t *testing.T) {
+	text := strings.Repeat("already gzipped ", 1000)
+	var gzipped bytes.Buffer
+	encoder := gzip.NewWriter(&gzipped)
+	io.WriteString(encoder, text)
+	encoder.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.Header().Set("Content-Encoding", "gzip")
+		writer.Write(gzipped.Bytes())
+	}))
+	defer upstream.Close()
+	server := httptest.NewServer(&Rule{Handler: testProxy(t, upstream, ProxyOptions{}), Compression: &testCompression})
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if encodings := response.Header.Values("Content-Encoding"); len(encodings) != 1 || encodings[0] != "gzip" {
+		t.Errorf("Content-Encoding is %q, want the upstream's gzip alone", encodings)
+	}
+	body, _ := io.ReadAll(response.Body)
+	if !bytes.Equal(body, gzipped.Bytes()) {
+		t.Error("the upstream's gzipped body was changed")
+	}
+}
+
+func TestCompressionOffPerHost(t *testing.T) {
+	withSettings(t, func(settings *Settings) {
+		settings.Compression = true
+		settings.Brotli = true
+	})
+	ruleSet, errs := loadTestRules(t, map[string]string{
+		"a.conf": "host = a.com\ntype = Redirect\nto = b.com\n",
+		"b.conf": "host = b.com\ntype = Redirect\nto = a.com\ncompression = off\n",
+		"c.conf": "host = c.com\ntype = Redirect\nto = a.com\ncompression = off\nbrotli = on\n",
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if compression := ruleSet.Hosts["a.com"][0].Compression; compression == nil || !compression.Gzip || !compression.Brotli {
+		t.Errorf("a host which doesn't say has %+v, want the global gzip and brotli", compression)
+	}
+	if compression := ruleSet.Hosts["b.com"][0].Compression; compression != nil {
+		t.Errorf("a host with compression = off has %+v", compression)
+	}
+	if compression := ruleSet.Hosts["c.com"][0].Compression; compression == nil || compression.Gzip || !compression.Brotli {
+		t.Errorf("a host with compression = off and brotli = on has %+v, want brotli alone", compression)
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, test := range []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=0.5", true},
+		{"br, gzip ; Q=0.8", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0", false},
+		{"gzip;q=0.000", false},
+		{"gzip;q=nope", false},
+		{"br", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"gzip, *;q=0", true},
+		{"gzip;q=0, *", false},
+		{"br, *;q=0", false},
+	} {
+		request := httptest.NewRequest("GET", "/", nil)
+		if test.accept != "" {
+			request.Header.Set("Accept-Encoding", test.accept)
+		}
+		if got := acceptsEncoding(request, "gzip"); got != test.want {
+			t.Errorf("Accept-Encoding %q: accepts gzip is %v, want %v", test.accept, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,1091 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Unknwon/goconfig"
+)
+
+// configDirs are the directories to load all the config files from, set with -config-dir. Each is a layer over
+// the ones before it, so a host in a later one replaces that host's rules from any earlier ones.
+var configDirs = dirList{"/etc/zproxy.d"}
+
+// dirList is the -config-dir flag, which may be given more than once and may be a comma separated list. The first
+// given replaces the default.
+type dirList []string
+
+func (dirs *dirList) String() string {
+	return strings.Join(*dirs, ",")
+}
+
+func (dirs *dirList) Set(value string) error {
+	if !configDirsSet {
+		*dirs = nil
+		configDirsSet = true
+	}
+	for _, dir := range strings.Split(value, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			*dirs = append(*dirs, dir)
+		}
+	}
+	if len(*dirs) == 0 {
+		return fmt.Errorf("no directories given")
+	}
+	return nil
+}
+
+// configDirsSet is whether -config-dir has been given yet
+var configDirsSet bool
+
+// configFile, when set with -config-file, is a single file of rules to load as well as (or instead of) configDir,
+// one per section. See combinedReaders.
+var configFile string
+
+// settingsFile holds the global (not per-host) settings. It is optional.
+var settingsFile = "/etc/zproxy.conf"
+
+// --- Config Errors ---
+
+// ConfigError is a problem with one key in one config file.
+type ConfigError struct {
+	File string
+	Key  string
+	Err  error
+}
+
+func (err *ConfigError) Error() string {
+	if err.Key == "" {
+		return fmt.Sprintf("%v: %v", err.File, err.Err)
+	}
+	return fmt.Sprintf("%v: %v: %v", err.File, err.Key, err.Err)
+}
+
+// ConfigReader reads values from the DEFAULT section of a config file, collecting every problem it comes across
+// rather than stopping at the first, so they can all be reported at once.
+type ConfigReader struct {
+	File string
+	Cfg  *goconfig.ConfigFile
+	// Within, when set, is the section of a combined file the values are in, falling back to the DEFAULT section
+	// for any it doesn't have. Its own sections are then "<Within>/<name>".
+	Within string
+	Errors []error
+	// read are the files the config pointed to (e.g. a body_file) and what was in them, for the config's hash
+	read []readFile
+}
+
+// readFile is a file a config pointed to and what was in it
+type readFile struct {
+	path     string
+	contents []byte
+}
+
+// ReadFile reads a file the config points to, keeping what was in it so a reload notices when only the file has
+// changed
+func (reader *ConfigReader) ReadFile(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	reader.read = append(reader.read, readFile{path, contents})
+	return contents, err
+}
+
+// value returns a key and whether it's set
+func (reader *ConfigReader) value(key string) (string, bool) {
+	if reader.Within != "" && hasKey(reader.Cfg, reader.Within, key) {
+		if value, err := reader.Cfg.GetValue(reader.Within, key); err == nil {
+			return value, true
+		}
+	}
+	value, err := reader.Cfg.GetValue("DEFAULT", key)
+	return value, err == nil
+}
+
+// hasKey is whether the section itself has the key. goconfig's GetValue falls back from a dotted section to its
+// parent, which would give [example.com.au] the keys of [example.com].
+func hasKey(cfg *goconfig.ConfigFile, section, key string) bool {
+	for _, name := range cfg.GetKeyList(section) {
+		if name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// section is the name of one of the reader's sections in its file
+func (reader *ConfigReader) section(name string) string {
+	if reader.Within == "" {
+		return name
+	}
+	return reader.Within + "/" + name
+}
+
+// Fail records a problem with a key.
+func (reader *ConfigReader) Fail(key string, err error) {
+	reader.Errors = append(reader.Errors, &ConfigError{reader.File, key, err})
+}
+
+// Failf records a problem with a key.
+func (reader *ConfigReader) Failf(key, format string, v ...interface{}) {
+	reader.Fail(key, fmt.Errorf(format, v...))
+}
+
+// Required returns a key which must be set.
+func (reader *ConfigReader) Required(key string) string {
+	value, _ := reader.value(key)
+	if value == "" {
+		reader.Failf(key, "is required")
+	}
+	return value
+}
+
+// String returns a key, or def if it isn't set.
+func (reader *ConfigReader) String(key, def string) string {
+	if value, ok := reader.value(key); ok && value != "" {
+		return value
+	}
+	return def
+}
+
+// OneOf returns a key, which must be one of the candidates, or def if it isn't set.
+func (reader *ConfigReader) OneOf(key, def string, candidates ...string) string {
+	value := reader.String(key, def)
+	for _, candidate := range candidates {
+		if value == candidate {
+			return value
+		}
+	}
+	reader.Failf(key, "should be one of %v, not %q", strings.Join(candidates, ", "), value)
+	return def
+}
+
+// Bool returns a key which is on/off, yes/no or true/false, or def if it isn't set.
+func (reader *ConfigReader) Bool(key string, def bool) bool {
+	value := strings.ToLower(reader.String(key, ""))
+	switch value {
+	case "":
+		return def
+	case "on", "yes":
+		return true
+	case "off", "no":
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		reader.Failf(key, "should be on or off, not %q", value)
+		return def
+	}
+	return b
+}
+
+// Int returns a key which is a whole number, or def if it isn't set.
+func (reader *ConfigReader) Int(key string, def int) int {
+	value := reader.String(key, "")
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		reader.Failf(key, "should be a number, not %q", value)
+		return def
+	}
+	return i
+}
+
+// Duration returns a key which is a duration such as "30s", or def if it isn't set.
+func (reader *ConfigReader) Duration(key string, def time.Duration) time.Duration {
+	value := reader.String(key, "")
+	if value == "" {
+		return def
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		reader.Failf(key, "should be a duration such as 30s, not %q", value)
+		return def
+	}
+	return duration
+}
+
+// OptionalDuration returns a key which is a duration, or nil if it isn't set.
+func (reader *ConfigReader) OptionalDuration(key string) *time.Duration {
+	if reader.String(key, "") == "" {
+		return nil
+	}
+	duration := reader.Duration(key, 0)
+	return &duration
+}
+
+// Regexp returns a key which is a regular expression, or nil if it isn't set.
+func (reader *ConfigReader) Regexp(key string) *regexp.Regexp {
+	value := reader.String(key, "")
+	if value == "" {
+		return nil
+	}
+	re, err := regexp.Compile(value)
+	if err != nil {
+		reader.Fail(key, err)
+	}
+	return re
+}
+
+// IP returns a key which is an IP address, or nil if it isn't set.
+func (reader *ConfigReader) IP(key string) net.IP {
+	value := reader.String(key, "")
+	if value == "" {
+		return nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		reader.Failf(key, "should be an IP address, not %q", value)
+	}
+	return ip
+}
+
+// URL returns a key which is an absolute URL, or nil if it isn't set.
+func (reader *ConfigReader) URL(key string) *url.URL {
+	value := reader.String(key, "")
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		reader.Fail(key, err)
+		return nil
+	}
+	if !u.IsAbs() || u.Host == "" {
+		reader.Failf(key, "%q should be an absolute URL", value)
+		return nil
+	}
+	return u
+}
+
+// HeaderTemplates reads all of the headers in the given section (if it exists) as templates.
+func (reader *ConfigReader) HeaderTemplates(section string) []HeaderTemplate {
+	var templates []HeaderTemplate
+	for _, name := range reader.Cfg.GetKeyList(reader.section(section)) {
+		value, err := reader.Cfg.GetValue(reader.section(section), name)
+		if err != nil {
+			reader.Fail("["+section+"] "+name, err)
+			continue
+		}
+		templates = append(templates, HeaderTemplate{
+			Name:  http.CanonicalHeaderKey(strings.TrimSpace(name)),
+			Value: value,
+		})
+	}
+	return templates
+}
+
+// Section reads all the keys in the given section (if it exists).
+func (reader *ConfigReader) Section(section string) map[string]string {
+	values := make(map[string]string)
+	for _, key := range reader.Cfg.GetKeyList(reader.section(section)) {
+		value, err := reader.Cfg.GetValue(reader.section(section), key)
+		if err != nil {
+			reader.Fail("["+section+"] "+key, err)
+			continue
+		}
+		values[key] = value
+	}
+	return values
+}
+
+// Replacements reads the body replacements in the given section (if it exists), where each key is what to find
+// and its value what to replace it with. Keys containing "=" or ":" need quoting, e.g. "http://backend:8080".
+func (reader *ConfigReader) Replacements(section string, regex bool) []Replacement {
+	var replacements []Replacement
+	for _, find := range reader.Cfg.GetKeyList(reader.section(section)) {
+		replace, err := reader.Cfg.GetValue(reader.section(section), find)
+		if err != nil {
+			reader.Fail("["+section+"] "+find, err)
+			continue
+		}
+		replacement := Replacement{Find: find, Replace: replace}
+		if regex {
+			replacement.Pattern, err = regexp.Compile(find)
+			if err != nil {
+				reader.Fail("["+section+"] "+find, err)
+				continue
+			}
+		}
+		replacements = append(replacements, replacement)
+	}
+	return replacements
+}
+
+// StatusMap reads the statuses in the given section (if it exists), where each key is an upstream's status and its
+// value the status to send the client in its place.
+func (reader *ConfigReader) StatusMap(section string) map[int]int {
+	var statuses map[int]int
+	for from, to := range reader.Section(section) {
+		fromStatus, err := strconv.Atoi(from)
+		if err != nil || fromStatus < 100 || fromStatus > 999 {
+			reader.Failf("["+section+"] "+from, "should be a status, not %q", from)
+			continue
+		}
+		toStatus, err := strconv.Atoi(to)
+		if err != nil || toStatus < 200 || toStatus > 599 {
+			reader.Failf("["+section+"] "+from, "should be a status from 200 to 599, not %q", to)
+			continue
+		}
+		if statuses == nil {
+			statuses = make(map[int]int)
+		}
+		statuses[fromStatus] = toStatus
+	}
+	return statuses
+}
+
+// --- Settings ---
+
+// Settings are the global options read from the DEFAULT section of the settingsFile.
+type Settings struct {
+	// DefaultRobots is a robots.txt served for hosts which don't have their own.
+	DefaultRobots string
+	// DefaultFavicon is a favicon.ico served for hosts which don't have their own.
+	DefaultFavicon string
+	// DefaultNotFoundPage is the HTML served with the 404 for hosts we don't know, read from default_not_found_page.
+	DefaultNotFoundPage []byte
+	// UnknownHostStatus is the status sent to hosts we don't know, with the default_not_found_page if there is one.
+	// 444 sends nothing at all, closing the connection, so scanners can't tell what's here.
+	UnknownHostStatus int
+	// UnknownHostRoot, when set, is the body of a 200 for a GET or HEAD of / at a host we don't know, e.g. a load
+	// balancer or monitor checking the edge by its IP. Off by default, so scanners get the same as for any path.
+	UnknownHostRoot string
+	// Strict makes problems which would otherwise be warnings (such as a missing Static dir) fatal.
+	Strict bool
+	// ReusePort sets SO_REUSEPORT on the listener, so two zproxys can overlap during a restart. ListenBacklog
+	// sets its accept backlog, if above zero. Both are Linux only.
+	ReusePort     bool
+	ListenBacklog int
+	// TrustedProxies are the peers whose X-Forwarded-* headers are passed on, rather than replaced.
+	TrustedProxies []*net.IPNet
+	// HeaderAllowlist, when set, are the only headers passed on to upstreams and back from them, including those
+	// zproxy adds itself such as X-Forwarded-For, for caches which mustn't see anything else.
+	HeaderAllowlist map[string]bool
+	// MaxConnsPerIP limits the open connections from any one client IP. Zero means no limit.
+	MaxConnsPerIP int
+	// MaxConnections limits the open connections across every listener, beyond which no more are accepted until
+	// one closes. Zero means no limit.
+	MaxConnections int
+	// ReadTimeout and WriteTimeout are the server's timeouts, which hosts may override. Zero means none.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// RequestTimeout caps how long any request (other than websockets and event streams) may take to serve,
+	// unless the host says otherwise. Zero means no limit.
+	RequestTimeout time.Duration
+	// MaxHeaderBytes limits the size of the request line and headers a client may send.
+	MaxHeaderBytes int
+	// KeepAlive is whether client connections are kept open between requests, which hosts may turn off for
+	// themselves with connection_close.
+	KeepAlive bool
+	// User and Group are who to run as once the listeners are bound, by name or number.
+	User  string
+	Group string
+	// Compression is whether hosts gzip their responses unless they say otherwise, likewise Brotli, both at
+	// CompressionLevel.
+	Compression      bool
+	Brotli           bool
+	CompressionLevel CompressionLevel
+	// CompressTypes are the content types (or prefixes of) compressed, unless a host says otherwise.
+	CompressTypes []string
+	// DrainPeriod, when set, is how long new requests get a 503 (with the DrainPage, if there is one) after a
+	// SIGTERM or SIGINT, before the server waits up to ShutdownTimeout for the rest to finish. Unset, zproxy
+	// stops at once.
+	DrainPeriod     time.Duration
+	DrainPage       string
+	ShutdownTimeout time.Duration
+	// GracefulUpgrade has a SIGUSR2 start a new zproxy on our sockets and hand over to it, see upgrade.go
+	GracefulUpgrade bool
+	// StartupDelay is how long to wait before listening, and WaitForUpstreams how long (at most) to then wait for
+	// every upstream to take connections, so a load balancer holds traffic until they're ready. Zero doesn't wait.
+	StartupDelay     time.Duration
+	WaitForUpstreams time.Duration
+	// StaleCheckInterval, when set, is how often to look for config files changed since they were loaded.
+	StaleCheckInterval time.Duration
+	// LogLevel is "info" (the default) or "debug".
+	LogLevel string
+	// LogFormat is "text" (the default) or "json".
+	LogFormat string
+	// RequireHost turns away requests without a Host with a 400, otherwise they're served as DefaultHost, if set.
+	RequireHost bool
+	DefaultHost string
+	// CertDir, when set, is a directory of name.crt and name.key pairs to serve HTTPS on TLSAddress with, picked
+	// by SNI. DefaultCert names the pair for clients asking for a name none of them are for.
+	CertDir     string
+	DefaultCert string
+	TLSAddress  string
+	// TLSCritical is whether failing to listen on TLSAddress stops zproxy, as it does unless turned off, when
+	// otherwise it carries on serving plain HTTP only.
+	TLSCritical bool
+	// TLSMinVersion and TLSMaxVersion bound the TLS versions clients may use, the minimum being 1.2 unless set,
+	// and TLSCiphers limits the TLS 1.2 (and older) cipher suites to those listed. Zero and nil leave Go's defaults.
+	TLSMinVersion uint16
+	TLSMaxVersion uint16
+	TLSCiphers    []uint16
+	// TLSErrorLog is the level failed TLS handshakes are logged at, info or debug, or off to not log them.
+	// Whichever, each client's are logged at most once a minute.
+	TLSErrorLog string
+	// AccessLog, when set, is the file to log every request to, which SIGUSR1 reopens. It's gzipped if
+	// AccessLogCompress is on, which it is by default when the file's name ends in .gz.
+	AccessLog         string
+	AccessLogCompress bool
+	// LogURI is how much of each request's URI is logged, "full" (the default), "path" or "none".
+	LogURI string
+	// AccessLogFormat, when set, is what each access log line says, in place of the combined format
+	AccessLogFormat *AccessLogFormat
+}
+
+var settings = Settings{
+	MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+	ShutdownTimeout:   30 * time.Second,
+	KeepAlive:         true,
+	TLSAddress:        "localhost:443",
+	TLSCritical:       true,
+	UnknownHostStatus: http.StatusNotFound,
+	CompressionLevel:  defaultCompressionLevel,
+	CompressTypes:     compressibleTypes,
+}
+
+// loadSettings reads the settingsFile, if there is one
+func loadSettings() []error {
+	cfg, err := goconfig.LoadConfigFile(settingsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return []error{&ConfigError{File: settingsFile, Err: err}}
+	}
+	log.Println("Loading settings", settingsFile)
+	reader := &ConfigReader{File: settingsFile, Cfg: cfg}
+
+	settings.Strict = reader.Bool("strict", false)
+	settings.LogLevel = reader.OneOf("log_level", "info", "info", "debug")
+	settings.LogFormat = reader.OneOf("log_format", "text", "text", "json")
+	settings.LogURI = reader.OneOf("log_uri", "full", "full", "path", "none")
+	settings.AccessLog = reader.String("access_log", "")
+	settings.AccessLogCompress = reader.Bool("access_log_compress", strings.HasSuffix(settings.AccessLog, ".gz"))
+	if value := reader.String("access_log_format", ""); value != "" {
+		format, err := parseAccessLogFormat(value)
+		if err != nil {
+			reader.Fail("access_log_format", err)
+		}
+		settings.AccessLogFormat = format
+	}
+	settings.RequireHost = reader.Bool("require_host", false)
+	settings.DefaultHost = reader.String("default_host", "")
+	settings.CertDir = reader.String("cert_dir", "")
+	settings.DefaultCert = reader.String("default_cert", "")
+	settings.TLSAddress = reader.String("tls_address", settings.TLSAddress)
+	settings.TLSCritical = reader.Bool("tls_critical", settings.TLSCritical)
+	settings.TLSErrorLog = reader.OneOf("tls_error_log", "info", "info", "debug", "off")
+	settings.TLSMinVersion, err = parseTLSVersion(reader.String("tls_min_version", "1.2"))
+	if err != nil {
+		reader.Fail("tls_min_version", err)
+	}
+	if value := reader.String("tls_max_version", ""); value != "" {
+		settings.TLSMaxVersion, err = parseTLSVersion(value)
+		if err != nil {
+			reader.Fail("tls_max_version", err)
+		}
+	}
+	if settings.TLSMaxVersion != 0 && settings.TLSMaxVersion < settings.TLSMinVersion {
+		reader.Failf("tls_max_version", "is below tls_min_version")
+	}
+	settings.TLSCiphers, err = parseCipherSuites(reader.String("tls_ciphers", ""))
+	if err != nil {
+		reader.Fail("tls_ciphers", err)
+	}
+	settings.ReadTimeout = reader.Duration("read_timeout", 0)
+	settings.WriteTimeout = reader.Duration("write_timeout", 0)
+	settings.RequestTimeout = reader.Duration("request_timeout", 0)
+	settings.MaxHeaderBytes = reader.Int("max_header_bytes", http.DefaultMaxHeaderBytes)
+	settings.KeepAlive = reader.Bool("keep_alive", settings.KeepAlive)
+	settings.Compression = reader.Bool("compression", false)
+	settings.Brotli = reader.Bool("brotli", false)
+	settings.CompressionLevel, err = parseCompressionLevel(reader.String("compression_level", ""))
+	if err != nil {
+		reader.Fail("compression_level", err)
+	}
+	settings.CompressTypes = parseCompressTypes(reader.String("compress_types", ""))
+	settings.User = reader.String("user", "")
+	settings.Group = reader.String("group", "")
+	if settings.Group != "" && settings.User == "" {
+		reader.Failf("group", "is set without a user")
+	}
+	settings.DefaultRobots = reader.String("default_robots", "")
+	settings.DefaultFavicon = reader.String("default_favicon", "")
+	if page := reader.String("default_not_found_page", ""); page != "" {
+		settings.DefaultNotFoundPage, err = os.ReadFile(page)
+		if err != nil {
+			reader.Fail("default_not_found_page", err)
+		}
+	}
+	settings.UnknownHostStatus = reader.Int("unknown_host_status", settings.UnknownHostStatus)
+	if status := settings.UnknownHostStatus; status != 444 && (status < 200 || status > 599) {
+		reader.Failf("unknown_host_status", "should be a status from 200 to 599, or 444, not %d", status)
+	}
+	settings.UnknownHostRoot = reader.String("unknown_host_root", "")
+	settings.MaxConnsPerIP = reader.Int("max_conns_per_ip", 0)
+	settings.MaxConnections = reader.Int("max_connections", 0)
+	settings.TrustedProxies, err = parseTrustedProxies(reader.String("trusted_proxies", ""))
+	if err != nil {
+		reader.Fail("trusted_proxies", err)
+	}
+	settings.HeaderAllowlist = parseHeaderAllowlist(reader.String("header_allowlist", ""))
+	settings.ReusePort = reader.Bool("reuse_port", false)
+	settings.ListenBacklog = reader.Int("listen_backlog", 0)
+	settings.DrainPeriod = reader.Duration("drain_period", 0)
+	settings.DrainPage = reader.String("drain_page", "")
+	settings.ShutdownTimeout = reader.Duration("shutdown_timeout", settings.ShutdownTimeout)
+	settings.GracefulUpgrade = reader.Bool("graceful_upgrade", false)
+	settings.StartupDelay = reader.Duration("startup_delay", 0)
+	settings.StaleCheckInterval = reader.Duration("stale_check_interval", 0)
+	settings.WaitForUpstreams = reader.Duration("wait_for_upstreams", 0)
+
+	return reader.Errors
+}
+
+// --- Loading Rules ---
+
+// loadRule creates the rule described by a config file, returning the host it's for
+func loadRule(reader *ConfigReader) (string, *Rule) {
+	host := reader.Required("host")
+	log.Println("host=", host)
+	typ := reader.Required("type")
+	log.Println("type=", typ)
+
+	rule := &Rule{
+		Type:            typ,
+		Prefix:          reader.String("path", ""),
+		Pattern:         reader.Regexp("path_regex"),
+		ConnectionClose: reader.Bool("connection_close", false),
+		Quiet:           !reader.Bool("log", true),
+		Timeouts: Timeouts{
+			Read:    reader.OptionalDuration("read_timeout"),
+			Write:   reader.OptionalDuration("write_timeout"),
+			Request: reader.OptionalDuration("request_timeout"),
+		},
+	}
+
+	if value := reader.String("access_log_sample", ""); value != "" {
+		sample, err := strconv.ParseFloat(value, 64)
+		if err != nil || sample < 0 || sample > 1 {
+			reader.Failf("access_log_sample", "should be a number from 0 to 1, not %q", value)
+		} else {
+			rule.AccessLogSample = &sample
+		}
+	}
+
+	// HSTS is only set with a max-age, even if that's 0 (so browsers forget it)
+	includeSubdomains := reader.Bool("hsts_include_subdomains", false)
+	preload := reader.Bool("hsts_preload", false)
+	if reader.String("hsts_max_age", "") != "" {
+		value, err := hstsHeader(reader.Int("hsts_max_age", 0), includeSubdomains, preload)
+		if err != nil {
+			reader.Fail("hsts_max_age", err)
+		}
+		rule.HSTS = value
+	} else if includeSubdomains || preload {
+		reader.Failf("hsts_max_age", "is needed for hsts_include_subdomains and hsts_preload")
+	}
+
+	// it's for the whole host, as it's done before choosing the rule
+	if reader.String("normalize_path", "") != "" {
+		rule.NormalizePath = reader.OneOf("normalize_path", "redirect", normalizePaths...)
+	}
+
+	// compression can be turned on or off per host, otherwise it's the global setting, and "compression = off"
+	// turns brotli off too unless the host asks for it
+	thisCompression := Compression{
+		Gzip:  reader.Bool("compression", settings.Compression),
+		Level: settings.CompressionLevel,
+		Types: settings.CompressTypes,
+	}
+	compressionOff := reader.String("compression", "") != "" && !thisCompression.Gzip
+	thisCompression.Brotli = reader.Bool("brotli", settings.Brotli && !compressionOff)
+	if thisCompression.Gzip || thisCompression.Brotli {
+		if value := reader.String("compression_level", ""); value != "" {
+			level, err := parseCompressionLevel(value)
+			if err != nil {
+				reader.Fail("compression_level", err)
+			}
+			thisCompression.Level = level
+		}
+		if value := reader.String("compress_types", ""); value != "" {
+			thisCompression.Types = parseCompressTypes(value)
+		}
+		rule.Compression = &thisCompression
+	}
+
+	// body logging shows what would otherwise never be logged, including credentials the redaction misses, so
+	// make sure it's noticed
+	if reader.Bool("debug_body", false) {
+		log.Printf("WARNING: debug_body is on for %v, request and response bodies will be logged\n", host)
+		redact := strings.Split(reader.String("debug_body_redact", ""), ",")
+		rule.BodyLogging = newBodyLogging(reader.Int("debug_body_max", 4096), redact)
+	}
+
+	// depending on the type create the right handler
+	var err error
+	switch typ {
+	case "NotFound":
+		rule.Target = "404"
+		notFound := newNotFound()
+		if fallback := reader.String("fallback_to", ""); fallback != "" {
+			log.Println("fallback_to=", fallback)
+			rule.Target = fallback
+			// with the Proxy defaults, since anything more belongs in a Proxy entry
+			notFound.Fallback, err = newProxy(fallback, ProxyOptions{RewriteLocation: true, ForwardedStyle: "x-forwarded"})
+			if err != nil {
+				reader.Fail("fallback_to", err)
+			}
+		}
+		rule.Handler = notFound
+	case "Proxy":
+		// "split" shares the requests out between several upstreams, in place of the one "to"
+		split := reader.String("split", "")
+		to := split
+		if split == "" {
+			to = reader.Required("to")
+		}
+		log.Println("to=", to)
+		rule.Target = to
+		grpc := reader.Bool("grpc", false)
+		// with {name}s in "to" the rule matches on the path up to the first of them, and the template does the rest
+		var template *TargetTemplate
+		if split == "" && placeholder.MatchString(to) {
+			template, err = newTargetTemplate(to, rule.Prefix)
+			if err != nil {
+				reader.Fail("to", err)
+			} else {
+				rule.Prefix = template.Prefix
+			}
+		}
+		var sourceAddress *net.TCPAddr
+		if ip := reader.IP("source_address"); ip != nil {
+			if !isLocalIP(ip) {
+				reader.Failf("source_address", "%v isn't one of this machine's addresses", ip)
+			}
+			sourceAddress = &net.TCPAddr{IP: ip}
+		}
+		// with passthrough off OPTIONS are answered here, for backends which 405 them
+		optionsAllow := ""
+		if !reader.Bool("options_passthrough", true) {
+			optionsAllow = reader.String("options_allow", "GET, HEAD, POST, OPTIONS")
+		}
+		// unset, each cookie keeps the SameSite the upstream gave it
+		sameSite := ""
+		if reader.String("cookie_samesite", "") != "" {
+			sameSite = reader.OneOf("cookie_samesite", "", "Lax", "Strict", "None")
+		}
+		// retries of a request with the same Idempotency-Key are given the first's response, not passed on again
+		var idempotency *Idempotency
+		if reader.Bool("idempotency", false) {
+			idempotency, err = newIdempotency(reader.String("idempotency_methods", "POST, PATCH"),
+				reader.Duration("idempotency_ttl", 24*time.Hour), reader.Int("idempotency_max_keys", 10000),
+				reader.Int("idempotency_max_body_bytes", 1<<20))
+			if err != nil {
+				reader.Fail("idempotency", err)
+			}
+		}
+		options := ProxyOptions{
+			RequestHeaders:  reader.HeaderTemplates("request_headers"),
+			ResponseHeaders: reader.HeaderTemplates("response_headers"),
+			RemoveHeaders:   parseHeaderNames(reader.String("remove_header", "")),
+			Replacements:    reader.Replacements("body_replace", reader.Bool("body_replace_regex", false)),
+			RewriteLocation: reader.Bool("rewrite_location", true),
+			Cookies: CookieRewrite{
+				Domain:   reader.String("cookie_domain", ""),
+				Path:     reader.String("cookie_path", ""),
+				Secure:   reader.Bool("cookie_secure", false),
+				SameSite: sameSite,
+			},
+			OptionsAllow: optionsAllow,
+			StatusMap:    reader.StatusMap("status_map"),
+			GetBody:      reader.OneOf("get_body", "pass", getBodies...),
+			Idempotency:  idempotency,
+			HeaderLimit: newHeaderLimit(reader.Int("max_response_header_bytes", 0), reader.Int("max_response_headers", 0),
+				strings.Split(reader.String("response_header_strip", ""), ",")),
+			AccelHeader:       http.CanonicalHeaderKey(reader.String("accel_header", "")),
+			AccelRoot:         reader.String("accel_root", ""),
+			UpstreamTime:      reader.Bool("upstream_time", false),
+			DropInformational: !reader.Bool("informational_responses", true),
+			GRPC:              grpc,
+			Template:          template,
+			ForwardedStyle:    reader.OneOf("forwarded_style", "x-forwarded", forwardedStyles...),
+			Transport: TransportOptions{
+				DialTimeout:           reader.OptionalDuration("dial_timeout"),
+				SourceAddress:         sourceAddress,
+				TLSHandshakeTimeout:   reader.OptionalDuration("tls_handshake_timeout"),
+				ExpectContinueTimeout: reader.OptionalDuration("expect_continue_timeout"),
+				DisableCompression:    reader.Bool("disable_compression", false),
+				OutboundProxy:         reader.URL("outbound_proxy"),
+				IdleConnTimeout:       reader.OptionalDuration("idle_conn_timeout"),
+				DisableKeepAlives:     reader.Bool("disable_keep_alives", false),
+			},
+		}
+		// a copy of each request goes to the shadow as well, for trying out a new version on real traffic
+		if mirrorTo := reader.URL("mirror_to"); mirrorTo != nil {
+			max := reader.Int("mirror_max_concurrent", 100)
+			if max <= 0 {
+				reader.Failf("mirror_max_concurrent", "should be more than 0, not %d", max)
+				max = 1
+			}
+			options.Mirror = newMirror(mirrorTo, max, int64(reader.Int("mirror_max_body_bytes", 1<<20)),
+				reader.Duration("mirror_timeout", 30*time.Second), options.ForwardedStyle,
+				newTransport(mirrorTo, options.Transport))
+			log.Printf("Mirroring %v to %v\n", host, mirrorTo)
+		}
+		if timeout := options.Transport.IdleConnTimeout; timeout != nil {
+			log.Printf("Idle upstream connections are closed after %v (keep it below any firewall's idle timeout)\n", *timeout)
+		}
+		if options.Transport.DisableKeepAlives {
+			log.Println("Upstream keep-alives are off, each request gets a new connection")
+		}
+		if split != "" {
+			rule.Handler, err = newSplit(split, reader.String("split_cookie", ""), options)
+			if err != nil {
+				reader.Fail("split", err)
+			}
+		} else {
+			rule.Handler, err = newProxy(to, options)
+			if err != nil {
+				reader.Fail("to", err)
+			}
+		}
+		if (reader.String("accel_header", "") == "") != (reader.String("accel_root", "") == "") {
+			reader.Failf("accel_root", "accel_header and accel_root must be set together")
+		}
+		// gRPC clients can only make sense of the upstream's own responses, never a default page
+		rule.Defaults = !grpc
+		rule.GRPC = grpc
+	case "Static":
+		var static *Static
+		if name := reader.String("embed", ""); name != "" {
+			// built into the binary, rather than read from a dir
+			log.Println("embed=", name)
+			rule.Target = "embed:" + name
+			static, err = newEmbeddedStatic(name)
+			if err != nil {
+				reader.Fail("embed", err)
+				static = &Static{Dir: rule.Target}
+			}
+		} else {
+			dir := reader.Required("dir")
+			log.Println("dir=", dir)
+			rule.Target = dir
+			static, err = newStatic(dir)
+			if err != nil {
+				// a typo in dir would otherwise only show up as every request 404ing
+				if settings.Strict {
+					reader.Fail("dir", err)
+				} else {
+					log.Printf("Warning: Static(%v): %v\n", host, err)
+				}
+			}
+			// a dir which goes away while we're running (e.g. an NFS mount) gets 503s, rather than a 404 for everything
+			if interval := reader.Duration("dir_check_interval", 5*time.Second); interval > 0 {
+				static.DirCheck = newDirCheck(dir, interval, reader.String("dir_check_file", ""))
+				if page := reader.String("unavailable_page", ""); page != "" {
+					static.DirCheck.Page, err = reader.ReadFile(page)
+					if err != nil {
+						reader.Fail("unavailable_page", err)
+					}
+				}
+			}
+		}
+		// each HTML page is filled in with the request's nonce, which also means it can't be cached
+		if reader.Bool("csp_nonce", false) {
+			static.CSP = reader.String("csp_policy", defaultCSP)
+		}
+		static.OpaqueErrors = reader.Bool("opaque_errors", false)
+		static.TransferTimeout = reader.Duration("transfer_timeout", 0)
+		static.RemoveHeaders = parseHeaderNames(reader.String("remove_header", ""))
+		static.ResponseHeaders = reader.HeaderTemplates("response_headers")
+		static.Languages, err = newLanguages(reader.String("languages", ""), reader.String("language_cookie", ""))
+		if err != nil {
+			reader.Fail("languages", err)
+		}
+		rule.Handler = static
+		rule.Defaults = true
+	case "Files":
+		files := reader.Section("files")
+		if len(files) == 0 {
+			reader.Failf("[files]", "is required, mapping each path to its file")
+		}
+		rule.Target = strconv.Itoa(len(files)) + " files"
+		rule.Paths = make(map[string]bool)
+		for path := range files {
+			rule.Paths[path] = true
+		}
+		rule.Handler, err = newFiles(files)
+		if err != nil {
+			reader.Fail("[files]", err)
+		}
+	case "Respond":
+		respond := &Respond{Status: reader.Int("status", http.StatusOK), ContentType: reader.String("content_type", "")}
+		if respond.Status < 200 || respond.Status > 599 {
+			reader.Failf("status", "should be from 200 to 599, not %d", respond.Status)
+		}
+		// the body is one line inline, or anything at all from a file
+		respond.Body = []byte(reader.String("body", ""))
+		if file := reader.String("body_file", ""); file != "" {
+			if len(respond.Body) > 0 {
+				reader.Failf("body_file", "body and body_file can't both be set")
+			}
+			respond.Body, err = reader.ReadFile(file)
+			if err != nil {
+				reader.Fail("body_file", err)
+			}
+		}
+		if len(respond.Body) > 0 && !bodyAllowed(respond.Status) {
+			reader.Failf("body", "a %d can't have a body", respond.Status)
+		}
+		rule.Target = strconv.Itoa(respond.Status)
+		rule.Handler = respond
+	case "Redirect":
+		to := reader.Required("to")
+		log.Println("to=", to)
+		rule.Target = to
+		// unset, the scheme is whatever "to" says
+		scheme := ""
+		if reader.String("scheme", "") != "" {
+			scheme = reader.OneOf("scheme", "", "http", "https", "preserve")
+		}
+		redirect := newRedirect(to, scheme)
+		redirect.CacheControl = reader.String("cache_control", "")
+		redirect.Expires = reader.OptionalDuration("expires")
+		rule.Handler = redirect
+	case "":
+		// already reported as missing
+	default:
+		reader.Failf("type", "unknown type %q", typ)
+	}
+
+	return host, rule
+}
+
+// loadRules reads all files in the config directory, each of which is a rule for a host, and then each section of
+// the configFile, if there is one, returning every problem found in any of them. Files included by others which
+// don't name a host are only there to be shared, so aren't rules themselves.
+func loadRules(dirs []string) (*RuleSet, []error) {
+	var errs []error
+	included := make(map[string]bool)
+	layers := make([][]*ConfigReader, len(dirs))
+	for i, dir := range dirs {
+		readers, dirErrs, err := dirReaders(dir, included)
+		if err != nil {
+			return nil, []error{err}
+		}
+		layers[i] = readers
+		errs = append(errs, dirErrs...)
+	}
+	// the config file's rules are part of the last layer, just as if they were in the last dir
+	if configFile != "" {
+		combined, combinedErrs := combinedReaders(configFile, included)
+		layers[len(layers)-1] = append(layers[len(layers)-1], combined...)
+		errs = append(errs, combinedErrs...)
+	}
+
+	loaded := make(map[string][]*Rule)
+	from := make(map[string]int)
+	quiet := make(map[string]bool)
+	normalize := make(map[string]string)
+	grpc := false
+	hash := sha256.New()
+	for i, readers := range layers {
+		layer := make(map[string][]*Rule)
+		// paths are the files each host's paths came from, to spot a rule which would never be used
+		paths := make(map[string]string)
+		for _, reader := range readers {
+			if included[reader.File] && reader.String("host", "") == "" {
+				continue
+			}
+			hashConfig(hash, reader.Cfg)
+			host, rule := loadRule(reader)
+			hashRead(hash, reader.read)
+			errs = append(errs, reader.Errors...)
+			if rule.Paths == nil {
+				key := host + " " + rule.Path()
+				if file, ok := paths[key]; ok {
+					errs = append(errs, &ConfigError{File: reader.File, Key: "host", Err: fmt.Errorf(
+						"%v already has a rule for path %v in %v, so this one would never be used", host, rule.Path(), file)})
+				}
+				paths[key] = reader.File
+			}
+			layer[host] = append(layer[host], rule)
+		}
+		for host, hostRules := range layer {
+			if previous, ok := from[host]; ok {
+				log.Printf("Host %v in %v replaces the one in %v\n", host, dirs[i], dirs[previous])
+			}
+			loaded[host] = hostRules
+			from[host] = i
+		}
+	}
+
+	hosts := make([]string, 0, len(loaded))
+	for host, hostRules := range loaded {
+		hosts = append(hosts, host)
+		for _, rule := range hostRules {
+			if rule.Quiet {
+				quiet[host] = true
+			}
+			if rule.NormalizePath != "" {
+				normalize[host] = rule.NormalizePath
+			}
+			grpc = grpc || rule.GRPC
+		}
+	}
+	if len(dirs) > 1 {
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			log.Printf("Host %v from %v\n", host, dirs[from[host]])
+		}
+	}
+	return &RuleSet{Hosts: loaded, Hash: hex.EncodeToString(hash.Sum(nil)), Quiet: quiet, NormalizePath: normalize,
+		GRPC: grpc}, errs
+}
+
+// dirReaders reads every file in dir, giving the problems with them, or an error if dir can't be read. A dir which
+// doesn't exist is fine when there's a config file, which may be all there is.
+func dirReaders(dir string, included map[string]bool) ([]*ConfigReader, []error, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !(configFile != "" && os.IsNotExist(err)) {
+		return nil, nil, err
+	}
+
+	var errs []error
+	var readers []*ConfigReader
+	for _, f := range files {
+		log.Println("Loading", f.Name())
+		file := filepath.Join(dir, f.Name())
+		cfg, err := goconfig.LoadConfigFile(file)
+		if err != nil {
+			errs = append(errs, &ConfigError{File: file, Err: err})
+			continue
+		}
+		if err := resolveIncludes(cfg, "DEFAULT", file, []string{file}, included); err != nil {
+			errs = append(errs, &ConfigError{File: file, Key: "include", Err: err})
+		}
+		readers = append(readers, &ConfigReader{File: file, Cfg: cfg})
+	}
+	return readers, errs, nil
+}
+
+// combinedReaders reads a file holding many rules, one per section, e.g. "[example.com]". Each section's host is the
+// section's name unless it says otherwise, so one host can have several sections, e.g. "[example.com api]" with
+// "host = example.com". The DEFAULT section's keys are shared by every section which doesn't set them. A section's
+// own sections, such as its response_headers, are named after it, e.g. "[example.com/response_headers]".
+func combinedReaders(file string, included map[string]bool) ([]*ConfigReader, []error) {
+	log.Println("Loading", file)
+	cfg, err := goconfig.LoadConfigFile(file)
+	if err != nil {
+		return nil, []error{&ConfigError{File: file, Err: err}}
+	}
+
+	var readers []*ConfigReader
+	var errs []error
+	for _, section := range cfg.GetSectionList() {
+		if section == "DEFAULT" || strings.Contains(section, "/") {
+			continue
+		}
+		label := file + " [" + section + "]"
+		if err := resolveIncludes(cfg, section, file, []string{file}, included); err != nil {
+			errs = append(errs, &ConfigError{File: label, Key: "include", Err: err})
+		}
+		if !hasKey(cfg, section, "host") {
+			cfg.SetValue(section, "host", section)
+		}
+		readers = append(readers, &ConfigReader{File: label, Cfg: cfg, Within: section})
+	}
+	return readers, errs
+}
+
+// resolveIncludes merges the DEFAULT section of each file named by the section's "include" (a comma separated list,
+// relative to the including file) into the section. Keys the section already has win, then later includes over
+// earlier ones. Includes may include others, and stack is the chain of files so far, for spotting cycles. Every file
+// included is added to included.
+func resolveIncludes(cfg *goconfig.ConfigFile, section, file string, stack []string, included map[string]bool) error {
+	if !hasKey(cfg, section, "include") {
+		return nil
+	}
+	value := cfg.MustValue(section, "include")
+	if value == "" {
+		return nil
+	}
+	cfg.DeleteKey(section, "include")
+
+	names := strings.Split(value, ",")
+	for i := len(names) - 1; i >= 0; i-- {
+		name := strings.TrimSpace(names[i])
+		if name == "" {
+			continue
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(file), name)
+		}
+		name = filepath.Clean(name)
+		for _, seen := range stack {
+			if seen == name {
+				return fmt.Errorf("include cycle: %v -> %v", strings.Join(stack, " -> "), name)
+			}
+		}
+		included[name] = true
+
+		includedCfg, err := goconfig.LoadConfigFile(name)
+		if err != nil {
+			return err
+		}
+		if err := resolveIncludes(includedCfg, "DEFAULT", name, append(stack[:len(stack):len(stack)], name), included); err != nil {
+			return err
+		}
+		for _, key := range includedCfg.GetKeyList("DEFAULT") {
+			if hasKey(cfg, section, key) {
+				continue
+			}
+			value, _ := includedCfg.GetValue("DEFAULT", key)
+			cfg.SetValue(section, key, value)
+		}
+	}
+	return nil
+}
+
+// hashConfig adds what a config says to the hash, rather than how it says it, so comments, blank lines and the
+// order of the DEFAULT keys make no difference. The order of keys in other sections (e.g. replacements) does.
+func hashConfig(hash io.Writer, cfg *goconfig.ConfigFile) {
+	sections := cfg.GetSectionList()
+	sort.Strings(sections)
+	for _, section := range append([]string{"DEFAULT"}, sections...) {
+		keys := cfg.GetKeyList(section)
+		if section == "DEFAULT" {
+			sort.Strings(keys)
+		}
+		fmt.Fprintf(hash, "[%q]\n", section)
+		for _, key := range keys {
+			value, _ := cfg.GetValue(section, key)
+			fmt.Fprintf(hash, "%q=%q\n", key, value)
+		}
+	}
+	fmt.Fprintln(hash, "--")
+}
+
+// hashRead adds the files a config read to the hash, by what was in them
+func hashRead(hash io.Writer, read []readFile) {
+	for _, file := range read {
+		fmt.Fprintf(hash, "%q=%x\n", file.path, sha256.Sum256(file.contents))
+	}
+}
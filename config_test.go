@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCombinedSectionsDontShareKeys(t *testing.T) {
+	withSettings(t, func(settings *Settings) { settings.Compression = true })
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "off.conf"), []byte("compression = off\n"), 0644)
+	file := filepath.Join(dir, "sites.conf")
+	os.WriteFile(file, []byte(`[example.com]
+type = Redirect
+to = www.example.com
+include = off.conf
+
+[example.com.au]
+type = Redirect
+to = www.example.com.au
+`), 0644)
+	saved := configFile
+	configFile = file
+	t.Cleanup(func() { configFile = saved })
+
+	ruleSet, errs := loadTestRules(t, nil)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	parent, dotted := ruleSet.Hosts["example.com"], ruleSet.Hosts["example.com.au"]
+	if len(parent) != 1 || len(dotted) != 1 {
+		t.Fatalf("got %v rules for example.com and %v for example.com.au, want one each", len(parent), len(dotted))
+	}
+	if to := dotted[0].Handler.(*Redirect).To; to != "www.example.com.au" {
+		t.Errorf("example.com.au redirects to %q", to)
+	}
+	if parent[0].Compression != nil {
+		t.Errorf("example.com has compression %+v, though its include turns it off", parent[0].Compression)
+	}
+	if dotted[0].Compression == nil {
+		t.Error("example.com.au has compression off, from example.com's include")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- CSP Nonces ---
+
+// noncePlaceholder is replaced, in both the HTML and the policy, by each request's nonce
+const noncePlaceholder = "{{nonce}}"
+
+// defaultCSP is the Content-Security-Policy sent when csp_nonce is on and there's no csp_policy
+const defaultCSP = "script-src 'nonce-" + noncePlaceholder + "'"
+
+// newNonce makes a nonce for one request, 128 random bits
+func newNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// serveWithNonce serves the request with a new nonce filled in to any HTML and to the policy
+func serveWithNonce(handler http.Handler, policy string, writer http.ResponseWriter, request *http.Request) {
+	nonce, err := newNonce()
+	if err != nil {
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	nonceWriter := &nonceWriter{ResponseWriter: writer}
+	handler.ServeHTTP(nonceWriter, request)
+	nonceWriter.finish(request, nonce, policy)
+}
+
+// nonceWriter holds back a successful HTML response so its nonces can be filled in, passing anything else
+// straight on
+type nonceWriter struct {
+	http.ResponseWriter
+	status int
+	html   bool
+	buffer bytes.Buffer
+}
+
+func (w *nonceWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	w.html = code == http.StatusOK && strings.HasPrefix(w.Header().Get("Content-Type"), "text/html")
+	if !w.html {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *nonceWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.html {
+		return w.buffer.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *nonceWriter) Flush() {
+	if w.html {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *nonceWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.html {
+		return w.buffer.ReadFrom(src)
+	}
+	return readFrom(w.ResponseWriter, src)
+}
+
+func (w *nonceWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends the held back HTML, which is different every time so mustn't be cached
+func (w *nonceWriter) finish(request *http.Request, nonce, policy string) {
+	if !w.html {
+		return
+	}
+	body := bytes.ReplaceAll(w.buffer.Bytes(), []byte(noncePlaceholder), []byte(nonce))
+	header := w.Header()
+	header.Set("Content-Security-Policy", strings.ReplaceAll(policy, noncePlaceholder, nonce))
+	header.Set("Cache-Control", "no-store")
+	header.Del("Etag")
+	header.Del("Last-Modified")
+	header.Del("Accept-Ranges")
+	if request.Method == http.MethodHead {
+		// there's no body to measure, and the file's length is no longer the body's
+		header.Del("Content-Length")
+	} else {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNonceWriterReachesTheConnection(t *testing.T) {
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if err := http.NewResponseController(writer).SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Errorf("can't set a deadline from under the nonce writer: %v", err)
+		}
+		writer.Header().Set("Content-Type", "text/html")
+		io.WriteString(writer, `<script nonce="`+noncePlaceholder+`"></script>`)
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		serveWithNonce(handler, defaultCSP, writer, request)
+	}))
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	policy := response.Header.Get("Content-Security-Policy")
+	nonce := strings.TrimSuffix(strings.TrimPrefix(policy, "script-src 'nonce-"), "'")
+	if nonce == "" || nonce == policy || string(body) != `<script nonce="`+nonce+`"></script>` {
+		t.Errorf("got %q with the policy %q", body, policy)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// --- Body Logging ---
+
+// alwaysRedacted are the headers whose values are never logged, whatever debug_body_redact says
+var alwaysRedacted = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+// BodyLogging logs the start of each request's and response's body, up to Max bytes, for debugging. Redact names
+// the headers, and the JSON or form fields in bodies, whose values are hidden.
+type BodyLogging struct {
+	Max    int
+	Redact map[string]bool
+	fields []*regexp.Regexp
+}
+
+// newBodyLogging creates the body logging for a rule, redacting the named headers and fields as well as the usual
+// credentials
+func newBodyLogging(max int, redact []string) *BodyLogging {
+	logging := &BodyLogging{Max: max, Redact: make(map[string]bool)}
+	for _, name := range append(alwaysRedacted, redact...) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		logging.Redact[http.CanonicalHeaderKey(name)] = true
+		quoted := regexp.QuoteMeta(name)
+		logging.fields = append(logging.fields,
+			regexp.MustCompile(`(?i)("`+quoted+`"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\s]+)`),
+			regexp.MustCompile(`(?i)((?:^|[&?])`+quoted+`=)[^&\s]*`),
+		)
+	}
+	return logging
+}
+
+// wrap starts capturing the request's body and the response's, and the function returned logs them. Everything is
+// passed on as it arrives, only a copy of the first Max bytes is kept, so streaming still streams.
+func (logging *BodyLogging) wrap(writer http.ResponseWriter, request *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	requestBody := &capturedBody{max: logging.Max}
+	if request.Body != nil && request.Body != http.NoBody {
+		requestBody.ReadCloser = request.Body
+		request.Body = requestBody
+	}
+	requestHeader := request.Header.Clone()
+	responseWriter := &bodyLogWriter{ResponseWriter: writer, body: capturedBody{max: logging.Max}}
+
+	done := func() {
+		status := responseWriter.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		log.Printf("DEBUG BODY(%v) %v %v request%v: %v\n", request.Host, request.Method, logURI(request),
+			logging.headers(requestHeader), logging.body(requestBody))
+		log.Printf("DEBUG BODY(%v) %v %v response %d%v: %v\n", request.Host, request.Method, logURI(request),
+			status, logging.headers(writer.Header()), logging.body(&responseWriter.body))
+	}
+	return responseWriter, request, done
+}
+
+// headers formats the headers for the log, hiding the values of those to redact
+func (logging *BodyLogging) headers(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, name := range names {
+		for _, value := range header[name] {
+			if logging.Redact[name] {
+				value = "[REDACTED]"
+			}
+			out.WriteString(" " + name + "=" + value)
+		}
+	}
+	return out.String()
+}
+
+// body formats what was captured of a body for the log, hiding the values of the fields to redact
+func (logging *BodyLogging) body(body *capturedBody) string {
+	text := body.buffer.String()
+	for _, field := range logging.fields {
+		text = field.ReplaceAllString(text, `${1}[REDACTED]`)
+	}
+	if body.size > int64(body.buffer.Len()) {
+		return fmt.Sprintf("%q... (%d bytes, truncated)", text, body.size)
+	}
+	return fmt.Sprintf("%q (%d bytes)", text, body.size)
+}
+
+// capturedBody passes a body on and keeps a copy of the first max bytes of it
+type capturedBody struct {
+	io.ReadCloser
+	max    int
+	buffer bytes.Buffer
+	size   int64
+}
+
+func (body *capturedBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.capture(p[:n])
+	return n, err
+}
+
+func (body *capturedBody) capture(p []byte) {
+	body.size += int64(len(p))
+	if room := body.max - body.buffer.Len(); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+		body.buffer.Write(p)
+	}
+}
+
+// bodyLogWriter captures the start of the response's body and its status as it goes out
+type bodyLogWriter struct {
+	http.ResponseWriter
+	status int
+	body   capturedBody
+}
+
+func (w *bodyLogWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *bodyLogWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.body.capture(b[:n])
+	return n, err
+}
+
+func (w *bodyLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *bodyLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
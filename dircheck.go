@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// --- Static Dir Checks ---
+
+// DirCheck notices when a Static's dir goes away, e.g. an NFS mount dropping, so it serves a 503 (with Page, if
+// there is one) rather than a 404 or 500 for everything. The dir is looked at again in the background at most every
+// Interval, so a request never waits on a filesystem which may have hung, and each change is logged once.
+//
+// An unmounted mountpoint is still a dir, just an empty one, so a dir which was a mountpoint when the check was made
+// is unavailable once it's on the same device as its parent again. File, when set, is a file in the dir which has to
+// be there too, for a dir which wasn't mounted yet when zproxy started.
+type DirCheck struct {
+	Dir      string
+	Interval time.Duration
+	Page     []byte
+	File     string
+
+	mountpoint  bool
+	checking    atomic.Bool
+	checked     atomic.Int64
+	unavailable atomic.Bool
+}
+
+// newDirCheck makes a DirCheck of the dir, looking at it straight away
+func newDirCheck(dir string, interval time.Duration, file string) *DirCheck {
+	check := &DirCheck{Dir: dir, Interval: interval, File: file}
+	if info, err := os.Stat(dir); err == nil {
+		check.mountpoint, _ = isMountpoint(dir, info)
+	}
+	// any problem has already been warned about, as the Static was made
+	check.unavailable.Store(check.look() != nil)
+	check.checked.Store(time.Now().UnixNano())
+	return check
+}
+
+// available says whether the dir was there when last looked at, starting another look if that was Interval ago
+func (check *DirCheck) available() bool {
+	if time.Since(time.Unix(0, check.checked.Load())) >= check.Interval && check.checking.CompareAndSwap(false, true) {
+		go func() {
+			defer check.checking.Store(false)
+			check.check()
+		}()
+	}
+	return !check.unavailable.Load()
+}
+
+// check looks at the dir, logging if it's changed between available and unavailable
+func (check *DirCheck) check() {
+	err := check.look()
+	check.checked.Store(time.Now().UnixNano())
+	was := check.unavailable.Swap(err != nil)
+	switch {
+	case err != nil && !was:
+		log.Printf("Warning: Static dir %v is unavailable, serving 503s: %v\n", check.Dir, err)
+	case err == nil && was:
+		log.Printf("Static dir %v is available again\n", check.Dir)
+	}
+}
+
+// look gives what, if anything, is wrong with the dir
+func (check *DirCheck) look() error {
+	info, err := os.Stat(check.Dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", check.Dir)
+	}
+	if check.mountpoint {
+		if mountpoint, err := isMountpoint(check.Dir, info); err != nil {
+			return err
+		} else if !mountpoint {
+			return fmt.Errorf("%v is no longer mounted", check.Dir)
+		}
+	}
+	if check.File != "" {
+		if _, err := os.Stat(filepath.Join(check.Dir, check.File)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveUnavailable tells the client the site's files can't be got at just now
+func (check *DirCheck) serveUnavailable(writer http.ResponseWriter) {
+	writer.Header().Set("Retry-After", "30")
+	if check.Page == nil {
+		http.Error(writer, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(http.StatusServiceUnavailable)
+	writer.Write(check.Page)
+}
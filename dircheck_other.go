@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// isMountpoint can't tell on this platform, so a dir is never taken for one
+func isMountpoint(dir string, info os.FileInfo) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// eventually waits for the check's availability to come round to want, as it's looked at in the background
+func eventually(t *testing.T, check *DirCheck, want bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if check.available() == want {
+			return
+		}
+	}
+	t.Fatalf("%v is still available %v, want %v", check.Dir, !want, want)
+}
+
+func TestDirCheck(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "site")
+	os.Mkdir(dir, 0755)
+	check := newDirCheck(dir, 10*time.Millisecond, "")
+	if !check.available() {
+		t.Fatal("the dir is there, but unavailable")
+	}
+	os.Remove(dir)
+	eventually(t, check, false)
+	os.Mkdir(dir, 0755)
+	eventually(t, check, true)
+}
+
+func TestDirCheckFile(t *testing.T) {
+	// as an unmounted mountpoint is, an empty dir
+	dir := t.TempDir()
+	check := newDirCheck(dir, 10*time.Millisecond, ".mounted")
+	if check.available() {
+		t.Fatal("the dir has no .mounted in it, but is available")
+	}
+	os.WriteFile(filepath.Join(dir, ".mounted"), nil, 0644)
+	eventually(t, check, true)
+}
+
+func TestIsMountpoint(t *testing.T) {
+	dir := t.TempDir()
+	info, _ := os.Stat(dir)
+	if mountpoint, err := isMountpoint(dir, info); mountpoint || err != nil {
+		t.Errorf("%v is taken for a mountpoint, %v", dir, err)
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	info, err := os.Stat("/proc")
+	if err != nil {
+		t.Skip("no /proc")
+	}
+	if mountpoint, err := isMountpoint("/proc", info); !mountpoint || err != nil {
+		t.Errorf("/proc isn't taken for a mountpoint, %v", err)
+	}
+}
+
+func TestHashCoversUnavailablePage(t *testing.T) {
+	site, page := t.TempDir(), filepath.Join(t.TempDir(), "unavailable.html")
+	os.WriteFile(page, []byte("down for maintenance"), 0644)
+	files := map[string]string{"a.conf": "host = a.com\ntype = Static\ndir = " + site + "\nunavailable_page = " + page + "\n"}
+	first, errs := loadTestRules(t, files)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	os.WriteFile(page, []byte("back in an hour"), 0644)
+	if edited, _ := loadTestRules(t, files); edited.Hash == first.Hash {
+		t.Error("the hash is the same after the unavailable_page was edited")
+	}
+}
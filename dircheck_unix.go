@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// isMountpoint says whether the dir is on a different device to its parent, as it is while something's mounted on it
+func isMountpoint(dir string, info os.FileInfo) (bool, error) {
+	parent, err := os.Stat(filepath.Join(dir, ".."))
+	if err != nil {
+		return false, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	parentStat, parentOK := parent.Sys().(*syscall.Stat_t)
+	return ok && parentOK && stat.Dev != parentStat.Dev, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// --- Embedded Sites ---
+
+// embeddedSites are the static sites built into the binary, by name, for Static entries with "embed = name". Each
+// is added by a file only built with its own tag, such as embed_site.go.
+var embeddedSites = map[string]fs.FS{}
+
+// factory to create a Static handler serving one of the embeddedSites
+func newEmbeddedStatic(name string) (*Static, error) {
+	site, ok := embeddedSites[name]
+	if !ok && len(embeddedSites) == 0 {
+		return nil, fmt.Errorf("no site %q is built in, this binary has none", name)
+	}
+	if !ok {
+		names := make([]string, 0, len(embeddedSites))
+		for name := range embeddedSites {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("no site %q is built in, only: %v", name, strings.Join(names, ", "))
+	}
+	return &Static{
+		Dir:     "embed:" + name,
+		Handler: http.FileServer(http.FS(site)),
+	}, nil
+}
@@ -0,0 +1,22 @@
+//go:build embed_site
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// site is the site/ directory, built in with "go build -tags embed_site" and served with "embed = site". The
+// repo's site/ is only a placeholder page, for replacing with your own before building.
+//
+//go:embed all:site
+var site embed.FS
+
+func init() {
+	sub, err := fs.Sub(site, "site")
+	if err != nil {
+		panic(err)
+	}
+	embeddedSites["site"] = sub
+}
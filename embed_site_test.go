@@ -0,0 +1,21 @@
+//go:build embed_site
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEmbeddedSite(t *testing.T) {
+	static, err := newEmbeddedStatic("site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	static.ServeHTTP(recorder, httptest.NewRequest("GET", "http://a.com/", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("got %d %v for the site's index", recorder.Code, recorder.Header())
+	}
+}
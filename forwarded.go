@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// --- Forwarded Headers ---
+
+// forwardingHeaders are the headers saying who a request came from, which only a trusted proxy may set
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Port", "X-Real-Ip", "Forwarded"}
+
+// parseTrustedProxies reads a comma separated list of IPs and CIDRs
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedPeer says whether the request came straight from one of the trusted proxies
+func isTrustedPeer(request *http.Request) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range settings.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedStyles are the kinds of forwarding headers a Proxy can send: the de facto X-Forwarded-* ones, the
+// standard Forwarded (RFC 7239), or both
+var forwardedStyles = []string{"x-forwarded", "forwarded", "both"}
+
+// setForwardingHeaders fixes up the outbound request's forwarding headers, in the given style. Unless the client is
+// a trusted proxy anything it sent is a lie (or at least not ours to pass on), so they're replaced rather than
+// appended to. The ReverseProxy adds the client's IP to X-Forwarded-For afterwards, unless it's set to nil.
+func setForwardingHeaders(outbound, inbound *http.Request, style string) {
+	if !isTrustedPeer(inbound) {
+		for _, name := range forwardingHeaders {
+			outbound.Header.Del(name)
+		}
+	}
+
+	if style == "forwarded" {
+		// just the one kind; any of the others from a trusted proxy go on as they came
+		if _, ok := outbound.Header["X-Forwarded-For"]; !ok {
+			outbound.Header["X-Forwarded-For"] = nil
+		}
+	} else {
+		// worked out before the others are filled in, which would hide what a front proxy sent
+		if outbound.Header.Get("X-Forwarded-Port") == "" {
+			outbound.Header.Set("X-Forwarded-Port", forwardedPort(outbound, inbound))
+		}
+		if outbound.Header.Get("X-Forwarded-Proto") == "" {
+			outbound.Header.Set("X-Forwarded-Proto", requestScheme(inbound))
+		}
+		if outbound.Header.Get("X-Forwarded-Host") == "" {
+			outbound.Header.Set("X-Forwarded-Host", inbound.Host)
+		}
+	}
+
+	if style == "forwarded" || style == "both" {
+		host, _, err := net.SplitHostPort(inbound.RemoteAddr)
+		if err != nil {
+			host = inbound.RemoteAddr
+		}
+		// an IPv6 address goes in brackets, which then need quoting
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		element := "for=" + forwardedValue(host) + ";host=" + forwardedValue(inbound.Host) + ";proto=" + requestScheme(inbound)
+		if prior := outbound.Header.Get("Forwarded"); prior != "" {
+			element = prior + ", " + element
+		}
+		outbound.Header.Set("Forwarded", element)
+	}
+}
+
+// forwardedPort is the port the client connected to. When a trusted front proxy has said the host or scheme the
+// client used, the port comes from those, as it's our listener's port that the front proxy connected to.
+func forwardedPort(outbound, inbound *http.Request) string {
+	if host := outbound.Header.Get("X-Forwarded-Host"); host != "" {
+		if _, port, err := net.SplitHostPort(host); err == nil {
+			return port
+		}
+	}
+	scheme := outbound.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		if addr, ok := inbound.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+				return port
+			}
+		}
+		scheme = requestScheme(inbound)
+	}
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// forwardedValue is the value as a Forwarded parameter, all token characters as it is, otherwise an RFC 9110
+// quoted-string. Control characters can't go in one at all, so they're dropped.
+func forwardedValue(value string) string {
+	if value != "" && strings.IndexFunc(value, func(c rune) bool { return !isTokenChar(c) }) < 0 {
+		return value
+	}
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c < ' ' && c != '\t' || c == 0x7f:
+			// dropped
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// isTokenChar says whether the character can be in an HTTP token (RFC 9110) unquoted
+func isTokenChar(c rune) bool {
+	return c < 0x7f && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// headerUpstream records the headers of each request it's sent
+func headerUpstream(t *testing.T) (*httptest.Server, chan http.Header) {
+	received := make(chan http.Header, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		received <- request.Header.Clone()
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, received
+}
+
+// spoofed sends a request with made up forwarding headers through the proxy, giving what the upstream got
+func spoofed(t *testing.T, options ProxyOptions) http.Header {
+	t.Helper()
+	upstream, received := headerUpstream(t)
+	server := httptest.NewServer(testProxy(t, upstream, options))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("X-Forwarded-For", "6.6.6.6")
+	request.Header.Set("X-Forwarded-Proto", "https")
+	request.Header.Set("X-Forwarded-Host", "bank.com")
+	request.Header.Set("X-Real-Ip", "6.6.6.6")
+	request.Header.Set("Forwarded", "for=6.6.6.6;proto=https")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return <-received
+}
+
+func TestSpoofedForwardingFromUntrustedPeer(t *testing.T) {
+	withSettings(t, func(settings *Settings) { settings.TrustedProxies = nil })
+	header := spoofed(t, ProxyOptions{})
+	for name, want := range map[string]string{"X-Forwarded-For": "127.0.0.1", "X-Forwarded-Proto": "http",
+		"X-Real-Ip": "", "Forwarded": ""} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%v is %q, want %q", name, got, want)
+		}
+	}
+	if host := header.Get("X-Forwarded-Host"); host == "bank.com" {
+		t.Errorf("X-Forwarded-Host is the spoofed %q", host)
+	}
+
+	header = spoofed(t, ProxyOptions{ForwardedStyle: "forwarded"})
+	if forwarded := header.Get("Forwarded"); forwarded == "" || strings.Contains(forwarded, "6.6.6.6") {
+		t.Errorf("Forwarded is %q, want only ours", forwarded)
+	}
+}
+
+func TestSpoofedForwardingFromTrustedPeer(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.1, 127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, func(settings *Settings) { settings.TrustedProxies = trusted })
+	header := spoofed(t, ProxyOptions{})
+	for name, want := range map[string]string{"X-Forwarded-For": "6.6.6.6, 127.0.0.1", "X-Forwarded-Proto": "https",
+		"X-Forwarded-Host": "bank.com", "X-Real-Ip": "6.6.6.6"} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%v is %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies("10.0.0.1, ::1, 192.168.0.0/16,")
+	if err != nil || len(nets) != 3 {
+		t.Fatalf("got %v, %v", nets, err)
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("no error for a bad CIDR")
+	}
+}
+
+func TestForwardedValue(t *testing.T) {
+	for value, want := range map[string]string{
+		"example.com":     "example.com",
+		"[::1]:8080":      `"[::1]:8080"`,
+		"":                `""`,
+		`a"b\c`:           `"a\"b\\c"`,
+		"bad\r\nhost\x7f": `"badhost"`,
+		"tab\there":       "\"tab\there\"",
+		"caf\xc3\xa9.com": "\"caf\xc3\xa9.com\"",
+	} {
+		if got := forwardedValue(value); got != want {
+			t.Errorf("forwardedValue(%q) is %q, want %q", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// h2cServer serves the handler over HTTP/1 and HTTP/2 without TLS, as a gRPC server does
+func h2cServer(t *testing.T, handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// grpcEcho is a tiny gRPC server which streams each message back as soon as it arrives, then ends the call with an
+// OK status in the trailers
+func grpcEcho(writer http.ResponseWriter, request *http.Request) {
+	if request.ProtoMajor != 2 || request.Header.Get("Content-Type") != "application/grpc" {
+		http.Error(writer, "not a gRPC call", http.StatusUnsupportedMediaType)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/grpc")
+	writer.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	writer.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(writer)
+	controller.Flush()
+	for {
+		message, err := readGRPCMessage(request.Body)
+		if err != nil {
+			break
+		}
+		writeGRPCMessage(writer, message)
+		controller.Flush()
+	}
+	writer.Header().Set("Grpc-Status", "0")
+	writer.Header().Set("Grpc-Message", "echoed")
+}
+
+// writeGRPCMessage writes the message in gRPC's framing, uncompressed with a 4 byte length in front
+func writeGRPCMessage(writer io.Writer, message string) error {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	_, err := writer.Write(append(frame, message...))
+	return err
+}
+
+// readGRPCMessage reads the next message in gRPC's framing
+func readGRPCMessage(reader io.Reader) (string, error) {
+	var frame [5]byte
+	if _, err := io.ReadFull(reader, frame[:]); err != nil {
+		return "", err
+	}
+	message := make([]byte, binary.BigEndian.Uint32(frame[1:]))
+	_, err := io.ReadFull(reader, message)
+	return string(message), err
+}
+
+func TestGRPCStreamsBothWays(t *testing.T) {
+	upstream := h2cServer(t, http.HandlerFunc(grpcEcho))
+	rule := &Rule{Handler: testProxy(t, upstream, ProxyOptions{GRPC: true})}
+	server := h2cServer(t, rule)
+
+	client := &http.Transport{Protocols: new(http.Protocols)}
+	client.Protocols.SetUnencryptedHTTP2(true)
+	defer client.CloseIdleConnections()
+	body, sending := io.Pipe()
+	request, _ := http.NewRequest("POST", server.URL+"/echo.Echo/Stream", body)
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("Te", "trailers")
+
+	response, err := client.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.ProtoMajor != 2 || response.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("got %v %v with Content-Type %q", response.Proto, response.Status, response.Header.Get("Content-Type"))
+	}
+
+	// each reply has to come back while the request is still going, or the stream isn't bidirectional
+	reader := bufio.NewReader(response.Body)
+	for _, message := range []string{"one", "two", "three"} {
+		go writeGRPCMessage(sending, message)
+		got := make(chan string, 1)
+		go func() {
+			echoed, _ := readGRPCMessage(reader)
+			got <- echoed
+		}()
+		select {
+		case echoed := <-got:
+			if echoed != message {
+				t.Fatalf("sent %q, got %q back", message, echoed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q wasn't echoed while the call was still going", message)
+		}
+	}
+
+	sending.Close()
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+	if status := response.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("the Grpc-Status trailer is %q, want 0", status)
+	}
+	if message := response.Trailer.Get("Grpc-Message"); message != "echoed" {
+		t.Errorf("the Grpc-Message trailer is %q, want echoed", message)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// --- Response Header Limits ---
+
+// HeaderLimit caps the headers of the upstream's responses, so a backend which sends dozens of cookies doesn't pass
+// them all on. When a response is over, the Strip headers are taken off, and if it's still over it's a 502.
+type HeaderLimit struct {
+	// MaxBytes and MaxCount are off when 0
+	MaxBytes int
+	MaxCount int
+	Strip    []string
+}
+
+// newHeaderLimit creates a HeaderLimit, or gives nil when there's no limit at all
+func newHeaderLimit(maxBytes, maxCount int, strip []string) *HeaderLimit {
+	if maxBytes == 0 && maxCount == 0 {
+		return nil
+	}
+	limit := &HeaderLimit{MaxBytes: maxBytes, MaxCount: maxCount}
+	for _, name := range strip {
+		if name = strings.TrimSpace(name); name != "" {
+			limit.Strip = append(limit.Strip, http.CanonicalHeaderKey(name))
+		}
+	}
+	return limit
+}
+
+// headerSize is the count of header lines and their total size as they'd be sent
+func headerSize(header http.Header) (int, int) {
+	count, size := 0, 0
+	for name, values := range header {
+		for _, value := range values {
+			count++
+			size += len(name) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	return count, size
+}
+
+// over says what the header breaks the limit by, or "" if it doesn't
+func (limit *HeaderLimit) over(header http.Header) string {
+	count, size := headerSize(header)
+	if limit.MaxCount > 0 && count > limit.MaxCount {
+		return fmt.Sprintf("%d headers, more than %d", count, limit.MaxCount)
+	}
+	if limit.MaxBytes > 0 && size > limit.MaxBytes {
+		return fmt.Sprintf("%d bytes of headers, more than %d", size, limit.MaxBytes)
+	}
+	return ""
+}
+
+// check strips the response's headers back within the limit, or gives an error if it can't be
+func (limit *HeaderLimit) check(response *http.Response) error {
+	reason := limit.over(response.Header)
+	if reason == "" {
+		return nil
+	}
+	// as the client asked for it, not the upstream's URL, and only as much of it as log_uri allows
+	inbound := inboundRequest(response.Request)
+	log.Printf("Header Limit(%v) %v %v\n", inbound.Host, logURI(inbound), reason)
+	if len(limit.Strip) == 0 {
+		return fmt.Errorf("response has %v", reason)
+	}
+
+	for _, name := range limit.Strip {
+		response.Header.Del(name)
+	}
+	if reason := limit.over(response.Header); reason != "" {
+		return fmt.Errorf("response still has %v after stripping %v", reason, limit.Strip)
+	}
+	debugf("Header Limit(%v) stripped %v\n", inbound.Host, limit.Strip)
+	return nil
+}
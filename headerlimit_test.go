@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderLimitLogsRedacted(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		for _, name := range []string{"X-Debug-1", "X-Debug-2", "X-Debug-3"} {
+			writer.Header().Set(name, "on")
+		}
+	}))
+	defer upstream.Close()
+	options := ProxyOptions{HeaderLimit: newHeaderLimit(0, 4, []string{"X-Debug-1", "X-Debug-2", "X-Debug-3"})}
+	server := httptest.NewServer(testProxy(t, upstream, options))
+	defer server.Close()
+	withSettings(t, func(settings *Settings) { settings.LogURI = "path" })
+	logged := captureLog(t)
+
+	response, err := http.Get(server.URL + "/account?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("X-Debug-1") != "" {
+		t.Errorf("got %v with %v, want the headers stripped", response.Status, response.Header)
+	}
+	var line string
+	for _, l := range strings.Split(logged.String(), "\n") {
+		if strings.Contains(l, "Header Limit(") {
+			line = l
+		}
+	}
+	if !strings.Contains(line, "/account") {
+		t.Fatalf("the path isn't logged: %q", line)
+	}
+	if upstreamHost := strings.TrimPrefix(upstream.URL, "http://"); strings.Contains(line, "token") ||
+		strings.Contains(line, upstreamHost) {
+		t.Errorf("logged the query or the upstream: %q", line)
+	}
+}
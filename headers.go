@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// --- Hop-by-hop Headers ---
+
+// hopByHopHeaders are only for the one connection they arrive on (RFC 9110 7.6.1), so they mustn't be passed on
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop deletes the hop-by-hop headers, along with any the Connection header names. The ReverseProxy does
+// this itself, but before response_headers are set, which could otherwise put them back.
+func removeHopByHop(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// isUpgrade says whether the header's Connection asks for an Upgrade, as a websocket's request or a 101 does
+func isUpgrade(header http.Header) bool {
+	for _, value := range header.Values("Connection") {
+		for _, option := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseHeaderAllowlist reads a comma separated list of header names, giving nil when there are none
+func parseHeaderAllowlist(value string) map[string]bool {
+	var allowed map[string]bool
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if allowed == nil {
+				allowed = make(map[string]bool)
+			}
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return allowed
+}
+
+// allowHeaders deletes every header not in header_allowlist, when there is one
+func allowHeaders(header http.Header) {
+	if settings.HeaderAllowlist == nil {
+		return
+	}
+	for name := range header {
+		if !settings.HeaderAllowlist[name] {
+			delete(header, name)
+		}
+	}
+}
+
+// --- Response Headers ---
+
+// parseHeaderNames reads a comma separated list of header names, e.g. remove_header's
+func parseHeaderNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// editResponseHeaders deletes the remove_header headers and then sets the response_headers, so a header can be
+// replaced as well as added or taken away
+func editResponseHeaders(header http.Header, remove []string, templates []HeaderTemplate, request *http.Request) {
+	for _, name := range remove {
+		header.Del(name)
+	}
+	setHeaders(header, templates, request)
+}
+
+// responseHeaderWriter edits the headers as the response goes out, for handlers such as the FileServer which set
+// their own at the last moment
+type responseHeaderWriter struct {
+	http.ResponseWriter
+	request   *http.Request
+	remove    []string
+	templates []HeaderTemplate
+	edited    bool
+}
+
+func (w *responseHeaderWriter) edit() {
+	if !w.edited {
+		w.edited = true
+		editResponseHeaders(w.Header(), w.remove, w.templates, w.request)
+	}
+}
+
+func (w *responseHeaderWriter) WriteHeader(code int) {
+	if code >= 200 {
+		w.edit()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseHeaderWriter) Write(b []byte) (int, error) {
+	w.edit()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseHeaderWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.edit()
+	return readFrom(w.ResponseWriter, src)
+}
+
+func (w *responseHeaderWriter) Flush() {
+	w.edit()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finalHeaderWriter sets headers as the final response goes out, rather than before the handler runs, as the
+// ReverseProxy clears the headers once it's relayed each of the upstream's 1xx responses, e.g. a 103 Early Hints
+type finalHeaderWriter struct {
+	http.ResponseWriter
+	header func(http.Header)
+	set    bool
+}
+
+func (w *finalHeaderWriter) setHeader() {
+	if !w.set {
+		w.set = true
+		w.header(w.Header())
+	}
+}
+
+func (w *finalHeaderWriter) WriteHeader(code int) {
+	if code >= 200 {
+		w.setHeader()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *finalHeaderWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *finalHeaderWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.setHeader()
+	return readFrom(w.ResponseWriter, src)
+}
+
+func (w *finalHeaderWriter) Flush() {
+	w.setHeader()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *finalHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// hopByHop are the headers which are only for the one connection they're sent over (RFC 9110 section 7.6.1)
+var hopByHop = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Te", "Upgrade"}
+
+func TestProxyStripsHopByHop(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		for _, name := range append(hopByHop, "X-Conn-Only") {
+			if value := request.Header.Get(name); value != "" {
+				t.Errorf("the upstream was sent %v: %v", name, value)
+			}
+		}
+		writer.Header().Set("Connection", "X-Upstream-Conn-Only")
+		writer.Header().Set("X-Upstream-Conn-Only", "secret")
+		writer.Header().Set("Keep-Alive", "timeout=5")
+		writer.Header().Set("Proxy-Authenticate", "Basic")
+	}))
+	defer upstream.Close()
+	// response_headers which would put them back
+	options := ProxyOptions{ResponseHeaders: []HeaderTemplate{{Name: "Keep-Alive", Value: "timeout=60"},
+		{Name: "Upgrade", Value: "h2c"}, {Name: "X-Kept", Value: "yes"}}}
+	server := httptest.NewServer(testProxy(t, upstream, options))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("Connection", "X-Conn-Only")
+	request.Header.Set("X-Conn-Only", "secret")
+	request.Header.Set("Keep-Alive", "timeout=5")
+	request.Header.Set("Proxy-Connection", "keep-alive")
+	request.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	request.Header.Set("Te", "gzip")
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	for _, name := range []string{"Keep-Alive", "Upgrade", "X-Upstream-Conn-Only", "Proxy-Authenticate"} {
+		if value := response.Header.Get(name); value != "" {
+			t.Errorf("the client was sent %v: %v", name, value)
+		}
+	}
+	if response.Header.Get("X-Kept") != "yes" {
+		t.Error("an end-to-end header from response_headers was stripped too")
+	}
+}
+
+func TestHeaderAllowlist(t *testing.T) {
+	withSettings(t, func(settings *Settings) { settings.HeaderAllowlist = parseHeaderAllowlist("content-type, X-Allowed") })
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		for name := range request.Header {
+			if name != "Content-Type" && name != "X-Allowed" && name != "Accept-Encoding" {
+				t.Errorf("the upstream was sent %v", name)
+			}
+		}
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.Header().Set("X-Allowed", "yes")
+		writer.Header().Set("X-Internal", "secret")
+	}))
+	defer upstream.Close()
+	server := httptest.NewServer(testProxy(t, upstream, ProxyOptions{}))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("X-Allowed", "yes")
+	request.Header.Set("Cookie", "session=secret")
+	request.Header.Set("User-Agent", "test")
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.Header.Get("X-Allowed") != "yes" || response.Header.Get("X-Internal") != "" {
+		t.Errorf("the client was sent %v", response.Header)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTP10WithoutHost(t *testing.T) {
+	withRules(t, map[string]http.Handler{"default.com": http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		io.WriteString(writer, "served as "+request.Host)
+	})})
+	server := httptest.NewServer(http.HandlerFunc(Handler))
+	t.Cleanup(server.Close)
+
+	for _, test := range []struct {
+		require     bool
+		defaultHost string
+		status      int
+		body        string
+	}{
+		{false, "default.com", http.StatusOK, "served as default.com"},
+		{false, "", http.StatusNotFound, ""},
+		{true, "default.com", http.StatusBadRequest, "Bad Request: missing Host header\n"},
+	} {
+		withSettings(t, func(settings *Settings) {
+			settings.RequireHost = test.require
+			settings.DefaultHost = test.defaultHost
+		})
+		response := rawResponse(t, server, "GET / HTTP/1.0\r\n\r\n")
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != test.status || (test.body != "" && string(body) != test.body) {
+			t.Errorf("require_host %v, default_host %q: got %v %q", test.require, test.defaultHost, response.Status, body)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "fmt"
+
+// --- HSTS ---
+
+// hstsPreloadMaxAge is the least max-age the browsers' preload list takes, a year
+const hstsPreloadMaxAge = 31536000
+
+// hstsHeader makes a Strict-Transport-Security value, checking preload gets what the preload list requires of it
+func hstsHeader(maxAge int, includeSubdomains, preload bool) (string, error) {
+	if maxAge < 0 {
+		return "", fmt.Errorf("max-age should be 0 or more seconds, not %d", maxAge)
+	}
+	if preload && (!includeSubdomains || maxAge < hstsPreloadMaxAge) {
+		return "", fmt.Errorf("preload needs includeSubDomains and a max-age of at least %d", hstsPreloadMaxAge)
+	}
+	value := fmt.Sprintf("max-age=%d", maxAge)
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if preload {
+		value += "; preload"
+	}
+	return value, nil
+}
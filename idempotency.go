@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Idempotency Keys ---
+
+// Idempotency remembers the upstream's response to each request with an Idempotency-Key, for TTL, and gives it
+// again to any request with the same key rather than passing it on, so a client retrying a POST doesn't make the
+// upstream do it twice. A duplicate which comes in while the first is still being served waits for its response.
+// It's kept in memory, for at most MaxKeys keys (the least recently used going first), so a restart or reload
+// forgets them all.
+//
+// Keys are only matched with the same method, path and query, and Authorization, so one client can't be given
+// another's response by sending their key. The body isn't compared. Responses over MaxBody, and 5xxs (which are
+// usually from the upstream not getting as far as doing anything), aren't kept so a retry is passed on as normal.
+type Idempotency struct {
+	Methods map[string]bool
+	TTL     time.Duration
+	MaxKeys int
+	MaxBody int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// idempotentResponse is what's remembered for a key. done is closed once the response is in, or once it's known
+// not to be kept, in which case ok is false.
+type idempotentResponse struct {
+	key     string
+	expires time.Time
+	done    chan struct{}
+	ok      bool
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+// newIdempotency makes an Idempotency for the comma separated methods, giving nil if there are none
+func newIdempotency(methods string, ttl time.Duration, maxKeys, maxBody int) (*Idempotency, error) {
+	if ttl <= 0 || maxKeys <= 0 {
+		return nil, fmt.Errorf("the ttl and number of keys must be more than 0")
+	}
+	idempotency := &Idempotency{Methods: make(map[string]bool), TTL: ttl, MaxKeys: maxKeys, MaxBody: maxBody,
+		entries: make(map[string]*list.Element), lru: list.New()}
+	for _, method := range strings.Split(methods, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			idempotency.Methods[method] = true
+		}
+	}
+	if len(idempotency.Methods) == 0 {
+		return nil, nil
+	}
+	return idempotency, nil
+}
+
+// idempotencyKey is what the request's response is remembered by, or "" if it isn't one to remember
+func (idempotency *Idempotency) idempotencyKey(request *http.Request) string {
+	key := request.Header.Get("Idempotency-Key")
+	if key == "" || !idempotency.Methods[request.Method] {
+		return ""
+	}
+	return strings.Join([]string{key, request.Method, request.Host, request.URL.RequestURI(),
+		request.Header.Get("Authorization")}, "\x00")
+}
+
+// serve gives the response remembered for the request's key if there is one, or has next serve it, remembering
+// its response
+func (idempotency *Idempotency) serve(next http.Handler, writer http.ResponseWriter, request *http.Request) {
+	key := idempotency.idempotencyKey(request)
+	if key == "" {
+		next.ServeHTTP(writer, request)
+		return
+	}
+
+	for {
+		response, first := idempotency.lookup(key)
+		if first {
+			recorder := &idempotencyRecorder{ResponseWriter: writer, max: idempotency.MaxBody}
+			defer idempotency.finish(response, recorder)
+			next.ServeHTTP(recorder, request)
+			return
+		}
+		select {
+		case <-response.done:
+		case <-request.Context().Done():
+			return
+		}
+		if response.ok {
+			dispatchf(request, "Replaying(%v) %v\n", request.Host, logURI(request))
+			response.replay(writer)
+			return
+		}
+		// the first wasn't kept, so go again, this time likely as the first
+	}
+}
+
+// lookup finds the key's response, or adds one to be filled in, saying it's first to have it served
+func (idempotency *Idempotency) lookup(key string) (*idempotentResponse, bool) {
+	idempotency.mu.Lock()
+	defer idempotency.mu.Unlock()
+	if element, ok := idempotency.entries[key]; ok {
+		response := element.Value.(*idempotentResponse)
+		if time.Now().Before(response.expires) {
+			idempotency.lru.MoveToFront(element)
+			return response, false
+		}
+		idempotency.remove(element)
+	}
+
+	response := &idempotentResponse{key: key, expires: time.Now().Add(idempotency.TTL), done: make(chan struct{})}
+	idempotency.entries[key] = idempotency.lru.PushFront(response)
+	for idempotency.lru.Len() > idempotency.MaxKeys {
+		idempotency.remove(idempotency.lru.Back())
+	}
+	return response, true
+}
+
+// remove forgets the element's key, which the lock must be held for
+func (idempotency *Idempotency) remove(element *list.Element) {
+	idempotency.lru.Remove(element)
+	delete(idempotency.entries, element.Value.(*idempotentResponse).key)
+}
+
+// finish fills in the response from what was recorded, or forgets it if it isn't one to keep, and lets anyone
+// waiting for it go
+func (idempotency *Idempotency) finish(response *idempotentResponse, recorder *idempotencyRecorder) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	keep := !recorder.over && recorder.status < 500 && recorder.header != nil
+	if keep {
+		response.status = recorder.status
+		response.header = recorder.header
+		response.body = recorder.body.Bytes()
+		response.ok = true
+	} else {
+		idempotency.mu.Lock()
+		if element, ok := idempotency.entries[response.key]; ok && element.Value == response {
+			idempotency.remove(element)
+		}
+		idempotency.mu.Unlock()
+	}
+	close(response.done)
+	if !keep {
+		debugf("Idempotency: not keeping a %d response\n", recorder.status)
+	}
+}
+
+// replay writes the remembered response, marked as a replay with Idempotent-Replayed
+func (response *idempotentResponse) replay(writer http.ResponseWriter) {
+	header := writer.Header()
+	for name, values := range response.header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Idempotent-Replayed", "true")
+	writer.WriteHeader(response.status)
+	writer.Write(response.body)
+}
+
+// idempotencyRecorder passes the response on to the client as normal while keeping a copy of it, up to max bytes
+// of body
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	max    int
+	status int
+	header http.Header
+	body   bytes.Buffer
+	over   bool
+}
+
+func (w *idempotencyRecorder) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *idempotencyRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		// the rest won't be copied, so there's no whole response to give again
+		w.over = true
+	}
+	if !w.over {
+		if w.body.Len()+n > w.max {
+			w.over = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+func (w *idempotencyRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
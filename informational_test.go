@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// earlyHintsUpstream sends a 103 Early Hints ahead of every response
+func earlyHintsUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		writer.WriteHeader(http.StatusEarlyHints)
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.Write([]byte("the page"))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// getInformational gets the URL, giving the 1xx statuses the client was sent ahead of the response
+func getInformational(t *testing.T, url string) ([]int, *http.Response) {
+	t.Helper()
+	var informational []int
+	trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+		informational = append(informational, code)
+		return nil
+	}}
+	request, _ := http.NewRequest("GET", url, nil)
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return informational, response
+}
+
+func TestProxyInformational(t *testing.T) {
+	upstream := earlyHintsUpstream(t)
+	for _, drop := range []bool{false, true} {
+		server := httptest.NewServer(testProxy(t, upstream, ProxyOptions{DropInformational: drop}))
+		defer server.Close()
+
+		informational, response := getInformational(t, server.URL)
+		if drop && len(informational) > 0 {
+			t.Errorf("dropping 1xx, the client got %v", informational)
+		}
+		if !drop && (len(informational) != 1 || informational[0] != http.StatusEarlyHints) {
+			t.Errorf("the client got %v, want the upstream's 103", informational)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("drop %v: got %v after them", drop, response.Status)
+		}
+	}
+}
+
+func TestInformationalResponsesConfig(t *testing.T) {
+	ruleSet, errs := loadTestRules(t, map[string]string{
+		"a.conf": "host = a.com\ntype = Proxy\nto = http://localhost:8080\n",
+		"b.conf": "host = b.com\ntype = Proxy\nto = http://localhost:8080\ninformational_responses = off\n",
+		// a fallback_to gets the Proxy defaults, which pass 1xx on
+		"c.conf": "host = c.com\ntype = NotFound\nfallback_to = http://localhost:8080\n",
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	for host, want := range map[string]bool{"a.com": false, "b.com": true} {
+		if drop := ruleSet.Hosts[host][0].Handler.(*Proxy).DropInformational; drop != want {
+			t.Errorf("%v drops 1xx %v, want %v", host, drop, want)
+		}
+	}
+	if ruleSet.Hosts["c.com"][0].Handler.(*NotFound).Fallback.DropInformational {
+		t.Error("the fallback_to proxy drops 1xx")
+	}
+}
+
+func TestConnectionCloseAfterEarlyHints(t *testing.T) {
+	for _, upstream := range []*httptest.Server{earlyHintsUpstream(t), fileUpstream(t, "text/plain", "no hints", time.Time{})} {
+		server := httptest.NewServer(&Rule{Handler: testProxy(t, upstream, ProxyOptions{}), ConnectionClose: true})
+		defer server.Close()
+
+		informational, response := getInformational(t, server.URL)
+		if !response.Close {
+			t.Errorf("after %v, the response doesn't close the connection: %v", informational, response.Header)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return errors.New("reuse_port is only supported on Linux")
+}
+
+func setBacklog(listener net.Listener, backlog int) error {
+	return errors.New("listen_backlog is only supported on Linux")
+}
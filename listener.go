@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Binding ---
+
+// listen binds the address, setting SO_REUSEPORT and the accept backlog when they're configured. Both are only
+// supported on Linux (see listen_linux.go).
+func listen(address string) (net.Listener, error) {
+	config := net.ListenConfig{}
+	if settings.ReusePort {
+		config.Control = reusePort
+	}
+	listener, err := config.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if settings.ListenBacklog > 0 {
+		if err := setBacklog(listener, settings.ListenBacklog); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// --- Socket Activation ---
+
+// listenFdsStart is the first file descriptor passed by systemd, straight after stdin, stdout and stderr
+const listenFdsStart = 3
+
+// activatedListeners returns the sockets passed to us by systemd socket activation (see sd_listen_fds(3)),
+// or none if we weren't started that way. The one named "https" (FileDescriptorName=https in the .socket unit), if
+// any, is also returned on its own, as the one to serve TLS on.
+func activatedListeners() ([]net.Listener, net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid LISTEN_FDS: %v", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// these are only meant for us, not any children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	var tlsListener net.Listener
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("socket activation fd %d: %v", fd, err)
+		}
+		listeners = append(listeners, listener)
+		if i < len(names) && names[i] == "https" {
+			tlsListener = listener
+		}
+	}
+	return listeners, tlsListener, nil
+}
+
+// --- Server Wide Connection Limit ---
+
+// LimitListener stops accepting connections while there are as many open as its limit allows, counting those from
+// every listener sharing the limit, until one of them closes.
+type LimitListener struct {
+	net.Listener
+	limit chan struct{}
+}
+
+// newConnLimit makes a limit of max open connections, to share between the listeners
+func newConnLimit(max int) chan struct{} {
+	return make(chan struct{}, max)
+}
+
+func NewLimitListener(listener net.Listener, limit chan struct{}) *LimitListener {
+	return &LimitListener{
+		Listener: listener,
+		limit:    limit,
+	}
+}
+
+func (l *LimitListener) Accept() (net.Conn, error) {
+	// waiting for room before accepting would have each listener's Accept holding a place even while idle, so the
+	// new connection waits here instead, with any more queueing up in the backlog
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case l.limit <- struct{}{}:
+	default:
+		log.Printf("Connection Limit(%d) reached, waiting for a connection to close\n", cap(l.limit))
+		l.limit <- struct{}{}
+	}
+	return &limitedConn{Conn: conn, release: func() { <-l.limit }}, nil
+}
+
+// --- Per IP Connection Limit ---
+
+// tooManyConns is written to a connection we're refusing, before it is closed
+const tooManyConns = "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+
+// PerIPLimitListener refuses connections from any IP which already has Max connections open.
+type PerIPLimitListener struct {
+	net.Listener
+	Max int
+	// TLS is whether its connections are going on to a TLS listener, in which case refused ones are just closed, as
+	// a plain HTTP 503 would be meaningless to the client
+	TLS bool
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func NewPerIPLimitListener(listener net.Listener, max int) *PerIPLimitListener {
+	return &PerIPLimitListener{
+		Listener: listener,
+		Max:      max,
+		active:   make(map[string]int),
+	}
+}
+
+func (l *PerIPLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := connIP(conn)
+		if l.acquire(ip) {
+			return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+		}
+
+		log.Printf("Too Many Connections(%v)\n", ip)
+		if l.TLS {
+			conn.Close()
+			continue
+		}
+		// a slow client mustn't hold up accepting everyone else's
+		go refuse(conn)
+	}
+}
+
+// refuse tells the client there are too many of its connections open, then closes this one
+func refuse(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte(tooManyConns))
+	conn.Close()
+}
+
+func (l *PerIPLimitListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] >= l.Max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+func (l *PerIPLimitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active[ip]--
+	if l.active[ip] <= 0 {
+		// don't keep every IP we've ever seen
+		delete(l.active, ip)
+	}
+}
+
+// limitedConn calls release exactly once, when it is closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (conn *limitedConn) Close() error {
+	err := conn.Conn.Close()
+	conn.once.Do(conn.release)
+	return err
+}
+
+// ReadFrom passes the copy on to the connection underneath, as net/http only sends a file with sendfile when the
+// connection is an io.ReaderFrom, which a *net.TCPConn is
+func (conn *limitedConn) ReadFrom(src io.Reader) (int64, error) {
+	if readerFrom, ok := conn.Conn.(io.ReaderFrom); ok {
+		return readerFrom.ReadFrom(src)
+	}
+	return io.Copy(conn.Conn, src)
+}
+
+// connIP returns the IP of the remote end of the connection
+func connIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// refusedWith opens two connections to a listener allowing one per IP, and gives what the second is sent
+func refusedWith(t *testing.T, tls bool) string {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewPerIPLimitListener(inner, 1)
+	listener.TLS = tls
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if i == 0 {
+			// make sure it's the first one counted
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		sent, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("the refused connection wasn't closed: %v", err)
+		}
+		return string(sent)
+	}
+	return ""
+}
+
+func TestPerIPLimitRefuses(t *testing.T) {
+	if sent := refusedWith(t, false); sent != tooManyConns {
+		t.Errorf("a refused connection was sent %q, want a 503", sent)
+	}
+}
+
+func TestPerIPLimitJustClosesTLS(t *testing.T) {
+	if sent := refusedWith(t, true); sent != "" {
+		t.Errorf("a refused TLS connection was sent %q, want it just closed", sent)
+	}
+}
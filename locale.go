@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// --- Language Negotiation ---
+
+// Languages has a Static serve each client the subdirectory of Dir for its language, e.g. en/ or fr/, picked from
+// its Accept-Language. A path already starting with one of them, or a Cookie naming one, wins over the header. The
+// first of Available is the default, for clients asking for none of them.
+type Languages struct {
+	Available []string
+	Cookie    string
+	matcher   language.Matcher
+}
+
+// newLanguages creates Languages from a comma separated list of the subdirectories, each of which must be a
+// language tag, or gives nil if there are none
+func newLanguages(value, cookie string) (*Languages, error) {
+	languages := &Languages{Cookie: cookie}
+	var tags []language.Tag
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		tag, err := language.Parse(name)
+		if err != nil {
+			return nil, err
+		}
+		languages.Available = append(languages.Available, name)
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	languages.matcher = language.NewMatcher(tags)
+	return languages, nil
+}
+
+// negotiate picks the language for the request from its cookie, or failing that its Accept-Language
+func (languages *Languages) negotiate(request *http.Request) string {
+	var preferred []string
+	if languages.Cookie != "" {
+		if cookie, err := request.Cookie(languages.Cookie); err == nil {
+			preferred = append(preferred, cookie.Value)
+		}
+	}
+	preferred = append(preferred, request.Header.Get("Accept-Language"))
+	_, index := language.MatchStrings(languages.matcher, preferred...)
+	return languages.Available[index]
+}
+
+// localise points the request at its language's subdirectory, unless its path is already in one
+func (languages *Languages) localise(writer http.ResponseWriter, request *http.Request) *http.Request {
+	first, _, _ := strings.Cut(strings.TrimPrefix(request.URL.Path, "/"), "/")
+	for _, name := range languages.Available {
+		if first == name {
+			return request
+		}
+	}
+
+	writer.Header().Add("Vary", "Accept-Language")
+	if languages.Cookie != "" {
+		writer.Header().Add("Vary", "Cookie")
+	}
+	localised := new(http.Request)
+	*localised = *request
+	u := *request.URL
+	u.Path = "/" + languages.negotiate(request) + request.URL.Path
+	u.RawPath = ""
+	localised.URL = &u
+	return localised
+}
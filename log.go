@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Logging ---
+
+// debugLogging turns on extra detail, set with "log_level = debug"
+var debugLogging bool
+
+// jsonLogging writes each log line as a JSON object, set with "log_format = json"
+var jsonLogging bool
+
+// debugf logs only when debugLogging is on
+func debugf(format string, v ...interface{}) {
+	if debugLogging {
+		log.Printf(format, v...)
+	}
+}
+
+// dispatchf logs where a request is going, unless its host has "log = off". Anything going wrong is logged with
+// log.Printf as usual.
+func dispatchf(request *http.Request, format string, v ...interface{}) {
+	if !rules.Load().Quiet[request.Host] {
+		log.Printf(format, v...)
+	}
+}
+
+// logURI is as much of the request's URI as log_uri says to log, since query strings (or whole paths) can hold
+// tokens and personal details: all of it, just the path, or none of it
+func logURI(request *http.Request) string {
+	switch settings.LogURI {
+	case "path":
+		return request.URL.EscapedPath()
+	case "none":
+		return ""
+	}
+	return request.RequestURI
+}
+
+// jsonLogWriter wraps each line written to the standard logger up as a JSON object
+type jsonLogWriter struct {
+	out io.Writer
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	err := writeJSON(w.out, map[string]interface{}{
+		"msg": strings.TrimSuffix(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeJSON writes the fields as one JSON log line, adding the time
+func writeJSON(out io.Writer, fields map[string]interface{}) error {
+	fields["time"] = time.Now().UTC().Format(time.RFC3339)
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(line, '\n'))
+	return err
+}
+
+// setupLogging applies the log_level and log_format settings to the standard logger
+func setupLogging() {
+	debugLogging = settings.LogLevel == "debug"
+	jsonLogging = settings.LogFormat == "json"
+	if jsonLogging {
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{out: os.Stderr})
+	}
+}
+
+// --- Startup Summary ---
+
+// Route is one host's rule and where it goes, for the startup summary.
+type Route struct {
+	Host   string `json:"host"`
+	Path   string `json:"path"`
+	Target string `json:"target"`
+}
+
+// types are all the types of rule, in the order they're summarised
+var types = []string{"Proxy", "Redirect", "Static", "Files", "Respond", "NotFound"}
+
+// logSummary logs the counts of each type of rule loaded and, when debugging, every rule's target
+func logSummary(ruleSet *RuleSet) {
+	routes := make(map[string][]Route)
+	for _, typ := range types {
+		routes[typ] = []Route{}
+	}
+	for host, hostRules := range ruleSet.Hosts {
+		for _, rule := range hostRules {
+			routes[rule.Type] = append(routes[rule.Type], Route{host, rule.Path(), rule.Target})
+		}
+	}
+
+	for _, typ := range types {
+		sort.SliceStable(routes[typ], func(i, j int) bool { return routes[typ][i].Host < routes[typ][j].Host })
+	}
+
+	if jsonLogging {
+		fields := map[string]interface{}{"msg": "Loaded routes"}
+		for _, typ := range types {
+			fields[typ] = routes[typ]
+		}
+		checkErr(writeJSON(os.Stderr, fields))
+		return
+	}
+
+	counts := make([]string, len(types))
+	total := 0
+	for i, typ := range types {
+		counts[i] = typ + "=" + strconv.Itoa(len(routes[typ]))
+		total += len(routes[typ])
+	}
+	log.Printf("Loaded %d hosts with %d rules: %s\n", len(ruleSet.Hosts), total, strings.Join(counts, " "))
+	for _, typ := range types {
+		for _, route := range routes[typ] {
+			debugf("  %v(%v%v) -> %v\n", typ, route.Host, route.Path, route.Target)
+		}
+	}
+}
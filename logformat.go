@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Access Log Format ---
+
+// accessLogEntry is everything about a request the access log can say
+type accessLogEntry struct {
+	request  *http.Request
+	status   int
+	size     int64
+	took     time.Duration
+	upstream *time.Duration
+	at       time.Time
+}
+
+// accessLogFields are the $names an access_log_format can use, as nginx's log_format has them. $http_<name> gives
+// any request header too, e.g. $http_x_request_id.
+var accessLogFields = map[string]func(entry *accessLogEntry) string{
+	"host": func(entry *accessLogEntry) string { return entry.request.Host },
+	"remote_addr": func(entry *accessLogEntry) string {
+		remote, _, err := net.SplitHostPort(entry.request.RemoteAddr)
+		if err != nil {
+			return entry.request.RemoteAddr
+		}
+		return remote
+	},
+	"remote_user":  func(entry *accessLogEntry) string { return "" },
+	"time_local":   func(entry *accessLogEntry) string { return entry.at.Format("02/Jan/2006:15:04:05 -0700") },
+	"time_iso8601": func(entry *accessLogEntry) string { return entry.at.Format(time.RFC3339) },
+	"request": func(entry *accessLogEntry) string {
+		return entry.request.Method + " " + orDash(logURI(entry.request)) + " " + entry.request.Proto
+	},
+	"request_method":         func(entry *accessLogEntry) string { return entry.request.Method },
+	"request_uri":            func(entry *accessLogEntry) string { return logURI(entry.request) },
+	"server_protocol":        func(entry *accessLogEntry) string { return entry.request.Proto },
+	"status":                 func(entry *accessLogEntry) string { return strconv.Itoa(entry.status) },
+	"body_bytes_sent":        func(entry *accessLogEntry) string { return strconv.FormatInt(entry.size, 10) },
+	"http_referer":           func(entry *accessLogEntry) string { return entry.request.Referer() },
+	"http_user_agent":        func(entry *accessLogEntry) string { return entry.request.UserAgent() },
+	"request_time":           func(entry *accessLogEntry) string { return fmt.Sprintf("%.3f", entry.took.Seconds()) },
+	"upstream_time":          upstreamTime,
+	"upstream_response_time": upstreamTime,
+}
+
+// upstreamTime is how long the upstream took, for a request which was proxied
+func upstreamTime(entry *accessLogEntry) string {
+	if entry.upstream == nil {
+		return ""
+	}
+	return fmt.Sprintf("%.3f", entry.upstream.Seconds())
+}
+
+// accessLogField matches a $name or ${name} in an access_log_format
+var accessLogField = regexp.MustCompile(`\$(?:\{([a-z0-9_]+)\}|([a-z0-9_]+))`)
+
+// AccessLogFormat is a compiled access_log_format, its text with a field between each piece
+type AccessLogFormat struct {
+	text   []string
+	fields []func(entry *accessLogEntry) string
+}
+
+// parseAccessLogFormat compiles an access_log_format, e.g. `$remote_addr "$request" $status $request_time`,
+// failing on any field it doesn't know
+func parseAccessLogFormat(value string) (*AccessLogFormat, error) {
+	format := &AccessLogFormat{}
+	last := 0
+	for _, match := range accessLogField.FindAllStringSubmatchIndex(value, -1) {
+		// ${name} or $name
+		var name string
+		if match[2] >= 0 {
+			name = value[match[2]:match[3]]
+		} else {
+			name = value[match[4]:match[5]]
+		}
+		field, ok := accessLogFields[name]
+		if !ok && strings.HasPrefix(name, "http_") {
+			header := textproto.CanonicalMIMEHeaderKey(strings.ReplaceAll(name[len("http_"):], "_", "-"))
+			field = func(entry *accessLogEntry) string { return entry.request.Header.Get(header) }
+			ok = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown field $%v", name)
+		}
+		format.text = append(format.text, value[last:match[0]])
+		format.fields = append(format.fields, field)
+		last = match[1]
+	}
+	format.text = append(format.text, value[last:])
+	return format, nil
+}
+
+// render gives the entry's line. As with nginx, an empty field is a "-", and quotes, backslashes and anything
+// unprintable in one are written as \xHH, so a client can't break up the line.
+func (format *AccessLogFormat) render(entry *accessLogEntry) string {
+	var line strings.Builder
+	for i, text := range format.text {
+		line.WriteString(text)
+		if i == len(format.fields) {
+			break
+		}
+		value := format.fields[i](entry)
+		if value == "" {
+			value = "-"
+		}
+		for j := 0; j < len(value); j++ {
+			if c := value[j]; c == '"' || c == '\\' || c < 0x20 || c > 0x7e {
+				fmt.Fprintf(&line, "\\x%02X", c)
+			} else {
+				line.WriteByte(c)
+			}
+		}
+	}
+	line.WriteByte('\n')
+	return line.String()
+}
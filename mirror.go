@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// --- Mirroring ---
+
+// Mirror sends a copy of each request a Proxy passes on to a shadow upstream as well, e.g. a new version of a
+// service being tried out on real traffic, throwing the shadow's response away. The copy goes in the background, so
+// the shadow being slow or down doesn't hold up the client, though a request's body is read in full (up to MaxBody)
+// before either gets it, so both can have it. At most Max copies are in flight at once, and any more aren't sent,
+// nor are requests with bodies over MaxBody or upgrades such as WebSockets. Anything going wrong with the shadow is
+// only logged with debug logging on.
+type Mirror struct {
+	To      *url.URL
+	Max     int
+	MaxBody int64
+	Timeout time.Duration
+
+	slots        chan struct{}
+	reverseProxy *httputil.ReverseProxy
+}
+
+// newMirror makes a Mirror to the upstream, sending its requests with the proxy's forwarding style over the transport
+func newMirror(to *url.URL, max int, maxBody int64, timeout time.Duration, forwardedStyle string,
+	transport http.RoundTripper) *Mirror {
+	mirror := &Mirror{To: to, Max: max, MaxBody: maxBody, Timeout: timeout, slots: make(chan struct{}, max)}
+	reverseProxy := httputil.NewSingleHostReverseProxy(to)
+	reverseProxy.Transport = transport
+	director := reverseProxy.Director
+	reverseProxy.Director = func(request *http.Request) {
+		director(request)
+		setForwardingHeaders(request, inboundRequest(request), forwardedStyle)
+		allowHeaders(request.Header)
+		if settings.HeaderAllowlist != nil && !settings.HeaderAllowlist["X-Forwarded-For"] {
+			request.Header["X-Forwarded-For"] = nil
+		}
+	}
+	reverseProxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, err error) {
+		debugf("Mirror(%v) %v %v: %v\n", request.Host, mirror.To, logURI(inboundRequest(request)), err)
+	}
+	mirror.reverseProxy = reverseProxy
+	return mirror
+}
+
+// send starts a copy of the request on its way to the shadow, leaving the request's body for the primary to read
+// as if it hadn't been touched
+func (mirror *Mirror) send(request *http.Request) {
+	inbound := inboundRequest(request)
+	if request.Header.Get("Upgrade") != "" {
+		return
+	}
+	select {
+	case mirror.slots <- struct{}{}:
+	default:
+		debugf("Mirror(%v) %v %v: %d already in flight, not sending\n", request.Host, mirror.To, logURI(inbound), mirror.Max)
+		return
+	}
+
+	var body []byte
+	if request.Body != nil && request.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(request.Body, mirror.MaxBody+1))
+		// the primary gets what was read and then the rest, any error included
+		request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), request.Body), request.Body}
+		if err != nil || int64(len(body)) > mirror.MaxBody {
+			<-mirror.slots
+			if err == nil {
+				debugf("Mirror(%v) %v %v: not sending a body over %d bytes\n", request.Host, mirror.To, logURI(inbound),
+					mirror.MaxBody)
+			}
+			return
+		}
+	}
+
+	// the shadow has as long as it needs, within the timeout, not just until the client has its response
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(request.Context()), mirror.Timeout)
+	shadow := request.Clone(ctx)
+	shadow.Body = http.NoBody
+	if body != nil {
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	shadow.ContentLength = int64(len(body))
+	shadow.TransferEncoding = nil
+	go func() {
+		defer func() { <-mirror.slots }()
+		defer cancel()
+		mirror.reverseProxy.ServeHTTP(&discardWriter{header: http.Header{}}, shadow)
+	}()
+}
+
+// discardWriter is where the shadow's responses go
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(code int) {}
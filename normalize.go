@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// --- Path Normalisation ---
+
+// normalizePaths are what normalize_path may be: redirect to the clean path (as http.ServeMux does, and the
+// default), clean it in place, clean it only for choosing the rule (the handler still gets it as sent), or leave it
+var normalizePaths = []string{"redirect", "on", "route", "off"}
+
+// cleanPath collapses "//" and resolves "." and "..", keeping a trailing slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// normalizePath applies the host's normalize_path to the request, giving the path to choose its rule by, or false
+// if it's been redirected. The escaped path is what's cleaned, so an encoded slash stays a part of its segment.
+func normalizePath(writer http.ResponseWriter, request *http.Request, mode string) (string, bool) {
+	escaped := request.URL.EscapedPath()
+	cleaned := cleanPath(escaped)
+	if mode == "off" || cleaned == escaped {
+		return request.URL.Path, true
+	}
+	unescaped, err := url.PathUnescape(cleaned)
+	if err != nil {
+		return request.URL.Path, true
+	}
+
+	switch mode {
+	case "on":
+		debugf("Normalised(%v) %v to %v\n", request.Host, escaped, cleaned)
+		request.URL.Path = unescaped
+		request.URL.RawPath = cleaned
+	case "route":
+	default:
+		location := cleaned
+		if request.URL.RawQuery != "" {
+			location += "?" + request.URL.RawQuery
+		}
+		log.Printf("Unclean Path(%v) %v\n", request.Host, logURI(request))
+		http.Redirect(writer, request, location, http.StatusMovedPermanently)
+		return "", false
+	}
+	return unescaped, true
+}
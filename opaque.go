@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// --- Opaque Errors ---
+
+// opaqueErrorWriter turns any error from the FileServer into a plain 404, so a 403 doesn't give away that a file
+// is there, just not readable
+type opaqueErrorWriter struct {
+	http.ResponseWriter
+	hidden bool
+}
+
+func (w *opaqueErrorWriter) WriteHeader(code int) {
+	if code >= 400 && code != http.StatusNotFound {
+		w.hidden = true
+		// drop what the FileServer set up for its own error, which would otherwise describe it
+		for name := range w.Header() {
+			delete(w.Header(), name)
+		}
+		http.Error(w.ResponseWriter, "404 page not found", http.StatusNotFound)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *opaqueErrorWriter) Write(b []byte) (int, error) {
+	if w.hidden {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *opaqueErrorWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.hidden {
+		return io.Copy(io.Discard, src)
+	}
+	return readFrom(w.ResponseWriter, src)
+}
+
+func (w *opaqueErrorWriter) Flush() {
+	if w.hidden {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *opaqueErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// --- Dropping Privileges ---
+
+// lookupUID returns the uid (and primary gid) for a user name or number
+func lookupUID(name string) (int, int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unknown user %q", name)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// lookupGID returns the gid for a group name or number
+func lookupGID(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		g, err = user.LookupGroupId(name)
+		if err != nil {
+			return 0, fmt.Errorf("unknown group %q", name)
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// dropPrivileges can't switch user on this platform, where there are no uids and gids to switch to
+func dropPrivileges(userName, groupName string) error {
+	return errors.New("user and group are only supported on Unix")
+}
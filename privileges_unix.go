@@ -0,0 +1,49 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+)
+
+// dropPrivileges switches to the given user and group (the user's own group if blank). It must be called after
+// the listeners have been bound but before any requests are served.
+func dropPrivileges(userName, groupName string) error {
+	uid, gid, err := lookupUID(userName)
+	if err != nil {
+		return err
+	}
+	if groupName != "" {
+		gid, err = lookupGID(groupName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// as we will be when we've been started by an upgrade, having already dropped them
+	if os.Getuid() == uid && os.Getgid() == gid {
+		log.Printf("Already running as uid=%d gid=%d\n", uid, gid)
+		return nil
+	}
+
+	// the group has to go first, since once we're not root we can't change it
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid(%d): %v", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid(%d): %v", uid, err)
+	}
+
+	// make sure it really happened, we never want to be serving as root by accident
+	if os.Getuid() != uid || os.Getgid() != gid {
+		return fmt.Errorf("still running as uid=%d gid=%d", os.Getuid(), os.Getgid())
+	}
+	log.Printf("Dropped privileges to uid=%d gid=%d\n", uid, gid)
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fileUpstream serves the content as a file would be, with ranges and a Last-Modified to check If-Range against
+func fileUpstream(t *testing.T, contentType, content string, modified time.Time) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", contentType)
+		http.ServeContent(writer, request, "", modified, strings.NewReader(content))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func getRange(t *testing.T, url string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	request, _ := http.NewRequest("GET", url, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	return response, string(body)
+}
+
+func TestProxyRange(t *testing.T) {
+	var content bytes.Buffer
+	for i := 0; content.Len() < 64<<10; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	modified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, contentType := range []string{"text/plain", "text/html"} {
+		upstream := fileUpstream(t, contentType, content.String(), modified)
+		options := ProxyOptions{Replacements: []Replacement{{Find: "line", Replace: "LINE"}}}
+		server := httptest.NewServer(&Rule{Handler: testProxy(t, upstream, options), Compression: &testCompression})
+		t.Cleanup(server.Close)
+
+		response, body := getRange(t, server.URL, map[string]string{"Range": "bytes=100-199"})
+		if response.StatusCode != http.StatusPartialContent || body != content.String()[100:200] ||
+			response.Header.Get("Content-Range") != fmt.Sprintf("bytes 100-199/%d", content.Len()) {
+			t.Errorf("%v: got %v %v %q", contentType, response.Status, response.Header.Get("Content-Range"), body)
+		}
+		if encoding := response.Header.Get("Content-Encoding"); encoding != "" {
+			t.Errorf("%v: the range is encoded with %v", contentType, encoding)
+		}
+
+		// still the same file, so still the range
+		response, body = getRange(t, server.URL, map[string]string{"Range": "bytes=0-9", "If-Range": modified.Format(http.TimeFormat)})
+		if response.StatusCode != http.StatusPartialContent || body != content.String()[:10] {
+			t.Errorf("%v: an If-Range which matches got %v %q", contentType, response.Status, body)
+		}
+		// changed since, so the whole of it
+		response, _ = getRange(t, server.URL, map[string]string{"Range": "bytes=0-9",
+			"If-Range": modified.Add(-time.Hour).Format(http.TimeFormat)})
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("%v: an If-Range which doesn't match got %v", contentType, response.Status)
+		}
+
+		// the whole of it is changed, so ranges of it can't be offered
+		response, _ = getRange(t, server.URL, nil)
+		if response.Header.Get("Accept-Ranges") != "" {
+			t.Errorf("%v: a changed full response offers ranges", contentType)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// --- Reloading ---
+
+// reload loads the config directory again and swaps in the new rules, unless there's a problem with them (in which
+// case the current ones stay) or they're the same as the current ones. Settings aren't reloaded, since most of
+// them only take effect at startup.
+func reload() {
+	log.Println("Reloading", configDirs.String())
+	started := time.Now()
+	ruleSet, errs := loadRules(configDirs)
+	if len(errs) > 0 {
+		log.Printf("Not reloading, found %d problem(s) in the config:\n", len(errs))
+		for _, err := range errs {
+			log.Println("  ", err)
+		}
+		return
+	}
+
+	loadedAt.Store(started.UnixNano())
+	if ruleSet.Hash == rules.Load().Hash {
+		log.Println("Config unchanged, not reloading")
+		return
+	}
+
+	// requests already being served keep hold of the rule they matched, and with it the old Proxy and its transport,
+	// so nothing is cut off, however long it goes on streaming for
+	if ruleSet.GRPC && !unencryptedHTTP2 {
+		log.Println("Warning: gRPC clients not using HTTPS can't be taken until a restart, which turns on h2c")
+	}
+	old := rules.Swap(ruleSet)
+	closeIdleConnections(old)
+	logSummary(ruleSet)
+}
+
+// closeIdleConnections closes the idle connections of the transports the old rules' upstreams and mirrors had to
+// themselves, since nothing will pick them up again. Those still in use, such as a long running stream or
+// WebSocket, are left to finish, and are closed once they've done rather than going back to the pool. Ones sharing
+// http.DefaultTransport are left alone, as the new rules are using it too.
+func closeIdleConnections(ruleSet *RuleSet) {
+	for _, proxy := range proxies(ruleSet) {
+		closeIdle(proxy.ReverseProxy.Transport)
+		if proxy.Mirror != nil {
+			closeIdle(proxy.Mirror.reverseProxy.Transport)
+		}
+	}
+}
+
+// closeIdle closes the transport's idle connections, unless it's (or wraps) http.DefaultTransport
+func closeIdle(transport http.RoundTripper) {
+	if timing, ok := transport.(*TimingTransport); ok {
+		transport = timing.RoundTripper
+	}
+	if transport, ok := transport.(*http.Transport); ok && transport != http.DefaultTransport {
+		transport.CloseIdleConnections()
+	}
+}
+
+// unencryptedHTTP2 is whether the server was started taking HTTP/2 without TLS, which can't be turned on later
+var unencryptedHTTP2 bool
+
+// loadedAt is when (in Unix nanoseconds) the config in use was last read, unchanged or not
+var loadedAt atomic.Int64
+
+// warnIfStale checks every interval for config files changed since they were read, and logs a warning about each
+// (once per change) as a nudge to reload
+func warnIfStale(interval time.Duration) {
+	warned := make(map[string]time.Time)
+	for range time.Tick(interval) {
+		var paths []string
+		for _, dir := range configDirs {
+			files, err := os.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				log.Println("Stale check:", err)
+				continue
+			}
+			for _, f := range files {
+				paths = append(paths, filepath.Join(dir, f.Name()))
+			}
+		}
+		if configFile != "" {
+			paths = append(paths, configFile)
+		}
+		loaded := time.Unix(0, loadedAt.Load())
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil || !info.ModTime().After(loaded) || warned[path].Equal(info.ModTime()) {
+				continue
+			}
+			warned[path] = info.ModTime()
+			log.Printf("Warning: %v has changed since the config was loaded, send a SIGHUP to reload\n", path)
+		}
+	}
+}
+
+// reloadOnSignal reloads the config, and any certificates, each time we get a SIGHUP
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reload()
+		if settings.CertDir != "" {
+			reloadCertificates()
+		}
+	}
+}
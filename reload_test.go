@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closedConns has the server send on the channel each time one of its connections is closed
+func closedConns(server *httptest.Server) chan struct{} {
+	closed := make(chan struct{}, 10)
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	return closed
+}
+
+// waitForClosed waits for count connections to be closed
+func waitForClosed(t *testing.T, closed chan struct{}, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d upstream connection(s) were closed", i, count)
+		}
+	}
+}
+
+func TestStreamSurvivesReload(t *testing.T) {
+	old := httptest.NewUnstartedServer(ticker(30*time.Millisecond, 10))
+	closed := closedConns(old)
+	old.Start()
+	defer old.Close()
+	repointed := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		io.WriteString(writer, "repointed")
+	}))
+	defer repointed.Close()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.conf")
+	// a dial_timeout gives the rule a transport of its own
+	rule := func(to string) {
+		os.WriteFile(file, []byte("host = a.com\ntype = Proxy\nto = "+to+"\ndial_timeout = 5s\n"), 0644)
+	}
+	rule(old.URL)
+	saved, savedDirs := rules.Load(), configDirs
+	configDirs = dirList{dir}
+	t.Cleanup(func() {
+		rules.Store(saved)
+		configDirs = savedDirs
+	})
+	reload()
+	server := httptest.NewServer(http.HandlerFunc(Handler))
+	defer server.Close()
+	get := func() *http.Response {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		request.Host = "a.com"
+		response, err := http.DefaultTransport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	stream := get()
+	defer stream.Body.Close()
+	reader := bufio.NewReader(stream.Body)
+	if line, err := reader.ReadString('\n'); err != nil || line != "data: tick\n" {
+		t.Fatalf("the stream started with %q, %v", line, err)
+	}
+	before := rules.Load()
+	rule(repointed.URL)
+	reload()
+	if rules.Load() == before {
+		t.Fatal("the repointed rule wasn't reloaded")
+	}
+
+	// the stream carries on from the old upstream to the end
+	rest, err := io.ReadAll(reader)
+	if ticks := 1 + strings.Count(string(rest), "tick"); ticks != 10 || err != nil {
+		t.Errorf("got %d of 10 ticks across the reload, %v", ticks, err)
+	}
+	response := get()
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "repointed" {
+		t.Errorf("a request after the reload got %q", body)
+	}
+	// and then its connection isn't kept, since nothing would use it again
+	waitForClosed(t, closed, 1)
+}
+
+func TestCloseIdleConnectionsSharedTo(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	closed := closedConns(upstream)
+	upstream.Start()
+	defer upstream.Close()
+	to, _ := url.Parse(upstream.URL)
+
+	// two rules with the same "to", each with a transport of its own, and a mirror with one too
+	timeout := 5 * time.Second
+	options := ProxyOptions{Transport: TransportOptions{DialTimeout: &timeout}}
+	a, b := testProxy(t, upstream, options), testProxy(t, upstream, options)
+	a.Mirror = newMirror(to, 1, 0, time.Second, "x-forwarded", newTransport(to, options.Transport))
+	ruleSet := &RuleSet{Hosts: map[string][]*Rule{"a.com": {{Handler: a}}, "b.com": {{Handler: b}}}}
+	for _, transport := range []http.RoundTripper{a.ReverseProxy.Transport, b.ReverseProxy.Transport,
+		a.Mirror.reverseProxy.Transport} {
+		response, err := (&http.Client{Transport: transport}).Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+	}
+
+	closeIdleConnections(ruleSet)
+	waitForClosed(t, closed, 3)
+}
+
+func TestHashCoversBodyFile(t *testing.T) {
+	dir := t.TempDir()
+	body := filepath.Join(dir, "maintenance.html")
+	os.WriteFile(body, []byte("back soon"), 0644)
+	files := map[string]string{"a.conf": "host = a.com\ntype = Respond\nstatus = 503\nbody_file = " + body + "\n"}
+	first, errs := loadTestRules(t, files)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	same, _ := loadTestRules(t, files)
+	os.WriteFile(body, []byte("back in an hour"), 0644)
+	edited, _ := loadTestRules(t, files)
+	if same.Hash != first.Hash {
+		t.Error("the hash changed with nothing else changing")
+	}
+	if edited.Hash == first.Hash {
+		t.Error("the hash is the same after the body_file was edited, so a reload would say the config's unchanged")
+	}
+}
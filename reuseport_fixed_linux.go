@@ -0,0 +1,7 @@
+//go:build linux && (386 || amd64 || arm)
+
+package main
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define for these ports. It's 0xf wherever Linux
+// uses the generic socket options, as these do.
+const soReusePort = 0xf
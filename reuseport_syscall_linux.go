@@ -0,0 +1,9 @@
+//go:build linux && !(386 || amd64 || arm)
+
+package main
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which the syscall package defines for these ports (it isn't 0xf on them all, e.g.
+// mips)
+const soReusePort = syscall.SO_REUSEPORT
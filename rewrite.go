@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// --- Location Rewriting ---
+
+// requestScheme is the scheme the client used to reach us
+func requestScheme(request *http.Request) string {
+	if request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// rewriteLocation points Location and Content-Location headers which refer to the upstream back at the host the
+// client used. Relative values and those for anywhere else are left as they are.
+func rewriteLocation(response *http.Response, upstream *url.URL) {
+	inbound := inboundRequest(response.Request)
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := response.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		location, err := url.Parse(value)
+		if err != nil || !location.IsAbs() {
+			continue
+		}
+		host := withoutDefaultPort(location.Scheme, location.Host)
+		if !strings.EqualFold(location.Scheme, upstream.Scheme) ||
+			!strings.EqualFold(host, withoutDefaultPort(upstream.Scheme, upstream.Host)) {
+			continue
+		}
+		location.Scheme = requestScheme(inbound)
+		location.Host = inbound.Host
+		response.Header.Set(name, location.String())
+	}
+}
+
+// withoutDefaultPort drops the scheme's default port from the host, so "example.com:443" and "example.com" are the
+// same https host
+func withoutDefaultPort(scheme, host string) string {
+	switch strings.ToLower(scheme) {
+	case "http":
+		return strings.TrimSuffix(host, ":80")
+	case "https":
+		return strings.TrimSuffix(host, ":443")
+	}
+	return host
+}
+
+// --- Status Mapping ---
+
+// mapStatus changes the response's status to what the status_map says, if it says anything
+func mapStatus(response *http.Response, statuses map[int]int) {
+	status, ok := statuses[response.StatusCode]
+	if !ok {
+		return
+	}
+	inbound := inboundRequest(response.Request)
+	debugf("Status Mapped(%v) %v %d to %d\n", inbound.Host, logURI(inbound), response.StatusCode, status)
+	response.StatusCode = status
+	response.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+}
+
+// --- Cookie Rewriting ---
+
+// CookieRewrite changes the attributes of the upstream's Set-Cookie headers, for upstreams which don't know the
+// host they're served on. Domain may be "{host}" for the client's host, or "none" to make cookies host-only.
+// Anything empty is left as the upstream had it.
+type CookieRewrite struct {
+	Domain   string
+	Path     string
+	Secure   bool
+	SameSite string
+}
+
+// isEmpty says whether the rewrite would change nothing
+func (rewrite CookieRewrite) isEmpty() bool {
+	return rewrite == CookieRewrite{}
+}
+
+// rewriteCookies rewrites each of the response's Set-Cookie headers. Attributes other than those being set are
+// kept as they are.
+func rewriteCookies(response *http.Response, rewrite CookieRewrite) {
+	cookies := response.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+
+	domain := rewrite.Domain
+	if domain == "{host}" {
+		domain = inboundRequest(response.Request).Host
+		if host, _, err := net.SplitHostPort(domain); err == nil {
+			domain = host
+		}
+	}
+
+	// SameSite=None is only allowed on a Secure cookie
+	secure := rewrite.Secure || rewrite.SameSite == "None"
+
+	rewritten := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		parts := strings.Split(cookie, ";")
+		kept := []string{strings.TrimSpace(parts[0])}
+		for _, part := range parts[1:] {
+			part = strings.TrimSpace(part)
+			name, _, _ := strings.Cut(part, "=")
+			switch {
+			case part == "":
+			case rewrite.Domain != "" && strings.EqualFold(name, "Domain"):
+			case rewrite.Path != "" && strings.EqualFold(name, "Path"):
+			case secure && strings.EqualFold(name, "Secure"):
+			case rewrite.SameSite != "" && strings.EqualFold(name, "SameSite"):
+			default:
+				kept = append(kept, part)
+			}
+		}
+		if domain != "" && domain != "none" {
+			kept = append(kept, "Domain="+domain)
+		}
+		if rewrite.Path != "" {
+			kept = append(kept, "Path="+rewrite.Path)
+		}
+		if secure {
+			kept = append(kept, "Secure")
+		}
+		if rewrite.SameSite != "" {
+			kept = append(kept, "SameSite="+rewrite.SameSite)
+		}
+		rewritten = append(rewritten, strings.Join(kept, "; "))
+	}
+	response.Header["Set-Cookie"] = rewritten
+}
+
+// --- Body Replacement ---
+
+// Replacement is one find and replace made to proxied HTML, like nginx's sub_filter. With a Pattern, Replace may
+// refer to its submatches as $1 and so on.
+type Replacement struct {
+	Find    string
+	Pattern *regexp.Regexp
+	Replace string
+}
+
+// Apply makes the replacement throughout the body
+func (replacement Replacement) Apply(body []byte) []byte {
+	if replacement.Pattern != nil {
+		return replacement.Pattern.ReplaceAll(body, []byte(replacement.Replace))
+	}
+	return bytes.ReplaceAll(body, []byte(replacement.Find), []byte(replacement.Replace))
+}
+
+// hasBody says whether there will be a body to look at in the response
+func hasBody(response *http.Response) bool {
+	if response.Request != nil && response.Request.Method == http.MethodHead {
+		return false
+	}
+	return response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusNotModified
+}
+
+// deflateReader decodes a deflate body, which should be zlib wrapped but is sometimes sent raw
+func deflateReader(body io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(body)
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// a zlib header says it's deflate, and the pair is a multiple of 31
+	if header[0]&0x0f == 8 && (uint(header[0])<<8|uint(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// replaceBody reads in an HTML response's body (decoding gzip, deflate or brotli if needed) and makes the
+// replacements. The replaced body goes out unencoded with its new length, and any compression is left to us.
+func replaceBody(response *http.Response, replacements []Replacement) error {
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") || !hasBody(response) {
+		return nil
+	}
+	// a range of the upstream's body can't be matched up with the replaced one, so ranges aren't offered
+	if response.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+	response.Header.Del("Accept-Ranges")
+
+	var body io.Reader = response.Body
+	switch response.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return err
+		}
+		body = gz
+	case "deflate":
+		deflate, err := deflateReader(response.Body)
+		if err != nil {
+			return err
+		}
+		body = deflate
+	case "br":
+		body = brotli.NewReader(response.Body)
+	default:
+		// we can't see inside any other encoding, so leave it be
+		return nil
+	}
+
+	data, err := io.ReadAll(body)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	for _, replacement := range replacements {
+		data = replacement.Apply(data)
+	}
+
+	response.Body = io.NopCloser(bytes.NewReader(data))
+	response.ContentLength = int64(len(data))
+	response.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	response.Header.Del("Content-Encoding")
+	// the body isn't byte for byte what the upstream's ETag was for any more
+	if etag := response.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		response.Header.Set("Etag", "W/"+etag)
+	}
+	return nil
+}
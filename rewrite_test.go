@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStatusMapLogsRedacted(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusForbidden)
+	}))
+	defer upstream.Close()
+	server := httptest.NewServer(testProxy(t, upstream, ProxyOptions{StatusMap: map[int]int{403: 404}}))
+	defer server.Close()
+	withSettings(t, func(settings *Settings) { settings.LogURI = "path" })
+	debugLogging = true
+	t.Cleanup(func() { debugLogging = false })
+	logged := captureLog(t)
+
+	response, err := http.Get(server.URL + "/admin?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("got %v, want the 403 mapped to a 404", response.Status)
+	}
+	for _, line := range strings.Split(logged.String(), "\n") {
+		if !strings.Contains(line, "Status Mapped(") {
+			continue
+		}
+		if upstreamHost := strings.TrimPrefix(upstream.URL, "http://"); !strings.Contains(line, "/admin 403 to 404") ||
+			strings.Contains(line, "token") || strings.Contains(line, upstreamHost) {
+			t.Errorf("logged %q, want the path alone", line)
+		}
+		return
+	}
+	t.Errorf("the mapping isn't logged: %q", logged.String())
+}
+
+func TestRewriteLocationDefaultPorts(t *testing.T) {
+	for _, test := range []struct {
+		upstream, location, want string
+	}{
+		{"http://backend", "http://backend/a", "http://example.com/a"},
+		{"http://backend", "http://backend:80/a", "http://example.com/a"},
+		{"http://backend:80", "http://backend/a", "http://example.com/a"},
+		{"https://backend:443", "https://BACKEND/a", "http://example.com/a"},
+		{"https://backend", "https://backend:443/a", "http://example.com/a"},
+		{"http://backend:8080", "http://backend/a", "http://backend/a"},
+		{"http://backend", "http://backend:443/a", "http://backend:443/a"},
+		{"https://backend", "http://backend/a", "http://backend/a"},
+	} {
+		upstream, _ := url.Parse(test.upstream)
+		response := &http.Response{Header: http.Header{}, Request: httptest.NewRequest("GET", "http://example.com/", nil)}
+		response.Header.Set("Location", test.location)
+		rewriteLocation(response, upstream)
+		if got := response.Header.Get("Location"); got != test.want {
+			t.Errorf("%v from %v: rewritten to %v, want %v", test.location, test.upstream, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// --- Sendfile ---
+
+// The FileServer copies a file into the ResponseWriter with io.Copy, which net/http turns into a sendfile (so the
+// file goes from the page cache to the socket without passing through us) when the ResponseWriter is an
+// io.ReaderFrom. Our writers wrap it, so those which don't need to see the bytes pass ReadFrom on with readFrom,
+// rather than leave the copy to go through Write 32KB at a time. HTTP/2 and anything compressed never get a sendfile.
+
+// readFrom copies src into the writer, by way of its ReadFrom when it has one
+func readFrom(writer http.ResponseWriter, src io.Reader) (int64, error) {
+	if readerFrom, ok := writer.(io.ReaderFrom); ok {
+		return readerFrom.ReadFrom(src)
+	}
+	return io.Copy(writer, src)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bigFile writes size random bytes to a file in a Static dir of its own, giving the dir
+func bigFile(tb testing.TB, size int) (string, []byte) {
+	dir := tb.TempDir()
+	content := make([]byte, size)
+	rand.Read(content)
+	if err := os.WriteFile(filepath.Join(dir, "big.bin"), content, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return dir, content
+}
+
+// limitedListeners are each way the connection limits wrap a listener, all of which should keep the sendfile
+var limitedListeners = map[string]func(net.Listener) net.Listener{
+	"unlimited":        func(listener net.Listener) net.Listener { return listener },
+	"max_connections":  func(listener net.Listener) net.Listener { return NewLimitListener(listener, newConnLimit(10)) },
+	"max_conns_per_ip": func(listener net.Listener) net.Listener { return NewPerIPLimitListener(listener, 10) },
+}
+
+// limitedServer serves the handler from a listener wrapped in the limit
+func limitedServer(tb testing.TB, handler http.Handler, limit func(net.Listener) net.Listener) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = limit(server.Listener)
+	server.Start()
+	tb.Cleanup(server.Close)
+	return server
+}
+
+func TestLimitedConnReadFrom(t *testing.T) {
+	dir, content := bigFile(t, 4<<20)
+	static, _ := newStatic(dir)
+	for name, limit := range limitedListeners {
+		server := limitedServer(t, static, limit)
+		response, err := http.Get(server.URL + "/big.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil || !bytes.Equal(body, content) {
+			t.Errorf("%v: got %d of %d bytes, %v", name, len(body), len(content), err)
+		}
+	}
+
+	// and it still copies when there's no connection underneath to take it
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	conn := &limitedConn{Conn: server, release: func() {}}
+	defer conn.Close()
+	if n, err := conn.ReadFrom(bytes.NewReader(content)); n != int64(len(content)) || err != nil {
+		t.Errorf("copied %d of %d bytes over a pipe, %v", n, len(content), err)
+	}
+}
+
+// hideReadFrom takes away the ReaderFrom of the ResponseWriter, as a writer wrapping it without passing it on
+// would, so the file is copied through 32KB at a time rather than sent with sendfile
+func hideReadFrom(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handler.ServeHTTP(struct{ http.ResponseWriter }{writer}, request)
+	})
+}
+
+// BenchmarkStaticLargeFile serves a 32MB file from each kind of listener, with sendfile and copied for comparison.
+// A limit's listener losing the sendfile shows up as it taking as long as its copied one. The client reading the
+// file takes its share of the CPU too, so the difference is less than it would be for zproxy alone.
+func BenchmarkStaticLargeFile(b *testing.B) {
+	dir, content := bigFile(b, 32<<20)
+	static, _ := newStatic(dir)
+	for name, limit := range limitedListeners {
+		for _, sendfile := range []bool{true, false} {
+			var handler http.Handler = static
+			label := name + "/sendfile"
+			if !sendfile {
+				handler = hideReadFrom(static)
+				label = name + "/copied"
+			}
+			b.Run(label, func(b *testing.B) {
+				server := limitedServer(b, handler, limit)
+				client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+				b.SetBytes(int64(len(content)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					response, err := client.Get(server.URL + "/big.bin")
+					if err != nil {
+						b.Fatal(err)
+					}
+					io.Copy(io.Discard, response.Body)
+					response.Body.Close()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Server Errors ---
+
+// handshakeError matches the line http.Server logs for a failed TLS handshake, capturing the client's IP
+var handshakeError = regexp.MustCompile(`^http: TLS handshake error from (\[[^\]]*\]|[^:]*):`)
+
+// handshakeErrorInterval is how often each client's failed handshakes are logged at most, so a scanner doesn't
+// fill the log
+const handshakeErrorInterval = time.Minute
+
+// serverErrorLog takes what http.Server logs about its connections. Failed TLS handshakes, which are mostly
+// scanners and clients too old to talk to us, are logged at tls_error_log's level and at most once a minute per
+// client, with a count of those skipped. Anything else is logged as it is.
+type serverErrorLog struct {
+	mu      sync.Mutex
+	clients map[string]*handshakeErrors
+}
+
+// handshakeErrors is when a client's failed handshakes were last logged, and how many have been since
+type handshakeErrors struct {
+	logged  time.Time
+	skipped int
+}
+
+func newServerErrorLog() *log.Logger {
+	return log.New(&serverErrorLog{clients: make(map[string]*handshakeErrors)}, "", 0)
+}
+
+func (l *serverErrorLog) Write(p []byte) (int, error) {
+	line := string(p)
+	match := handshakeError.FindStringSubmatch(line)
+	if match == nil {
+		log.Print(line)
+		return len(p), nil
+	}
+	if settings.TLSErrorLog == "off" {
+		return len(p), nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	client, ok := l.clients[match[1]]
+	if ok && now.Sub(client.logged) < handshakeErrorInterval {
+		client.skipped++
+		l.mu.Unlock()
+		return len(p), nil
+	}
+	skipped := 0
+	if ok {
+		skipped = client.skipped
+	}
+	// forget the clients which have gone quiet, so scanners passing through don't pile up
+	for ip, client := range l.clients {
+		if now.Sub(client.logged) >= handshakeErrorInterval {
+			delete(l.clients, ip)
+		}
+	}
+	l.clients[match[1]] = &handshakeErrors{logged: now}
+	l.mu.Unlock()
+
+	line = strings.TrimSuffix(line, "\n")
+	if skipped > 0 {
+		line = fmt.Sprintf("%v (and %d more since)", line, skipped)
+	}
+	if settings.TLSErrorLog == "debug" {
+		debugf("%s\n", line)
+	} else {
+		log.Println(line)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// --- Graceful Shutdown ---
+
+// draining is set once we've been told to shut down, after which new requests get the drain page
+var draining atomic.Bool
+
+// serveDrainPage tells the client we're restarting, and to come back on a new connection
+func serveDrainPage(writer http.ResponseWriter, request *http.Request) {
+	log.Printf("Draining(%v) %v\n", request.Host, logURI(request))
+	writer.Header().Set("Connection", "close")
+	writer.Header().Set("Retry-After", "5")
+	if settings.DrainPage == "" {
+		http.Error(writer, "Server restarting, please try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	page, err := os.ReadFile(settings.DrainPage)
+	if err != nil {
+		log.Println("Drain page:", err)
+		http.Error(writer, "Server restarting, please try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(http.StatusServiceUnavailable)
+	writer.Write(page)
+}
+
+// drainOnSignal waits for SIGTERM or SIGINT, then gives new requests the drain page for the drain period before
+// shutting the server down, which lets the requests already in flight finish. Calls done once it's all over.
+func drainOnSignal(server *http.Server, done func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+
+	log.Printf("Received %v, draining for %v\n", sig, settings.DrainPeriod)
+	draining.Store(true)
+	server.SetKeepAlivesEnabled(false)
+
+	// a second signal means stop waiting around
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	ctx, cancel := context.WithTimeout(context.Background(), settings.DrainPeriod)
+	select {
+	case <-ctx.Done():
+	case <-signals:
+	}
+	cancel()
+
+	log.Println("Shutting down, waiting up to", settings.ShutdownTimeout, "for requests to finish")
+	ctx, cancel = context.WithTimeout(context.Background(), settings.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Shutdown:", err)
+	}
+	done()
+}
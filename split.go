@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- Split ---
+
+// Split sends each request to one of its Variants at random by weight, e.g. 5% to a canary. With a Cookie each
+// client stays on the variant it got first.
+type Split struct {
+	Variants []*Variant
+	Total    int
+	Cookie   string
+	// random, when set, is used in place of the global source so the choices can be repeated, e.g.
+	// rand.New(rand.NewPCG(1, 2)) in a test. A *rand.Rand isn't safe to share between goroutines, so it's not for
+	// serving with.
+	random *rand.Rand
+}
+
+// Variant is one of the upstreams a Split sends requests to. ID, which is what the cookie holds, comes from To so it
+// stays the same when the split is reordered or reweighted.
+type Variant struct {
+	To     string
+	Weight int
+	ID     string
+	Proxy  *Proxy
+}
+
+func (split *Split) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	variant := split.sticky(request)
+	if variant == nil {
+		variant = split.choose()
+		if split.Cookie != "" {
+			cookie := &http.Cookie{Name: split.Cookie, Value: variant.ID, Path: "/", HttpOnly: true}
+			// on the final response, as any 1xx the upstream sends first takes the headers with it
+			writer = &finalHeaderWriter{ResponseWriter: writer, header: func(header http.Header) {
+				header.Add("Set-Cookie", cookie.String())
+			}}
+		}
+	}
+	dispatchf(request, "Split(%v) %v\n", request.Host, variant.To)
+	variant.Proxy.ServeHTTP(writer, request)
+}
+
+// sticky returns the variant the client's cookie says it's on, if it still exists
+func (split *Split) sticky(request *http.Request) *Variant {
+	if split.Cookie == "" {
+		return nil
+	}
+	cookie, err := request.Cookie(split.Cookie)
+	if err != nil {
+		return nil
+	}
+	for _, variant := range split.Variants {
+		if variant.ID == cookie.Value && variant.Weight > 0 {
+			return variant
+		}
+	}
+	return nil
+}
+
+// choose picks a variant at random, each in proportion to its weight
+func (split *Split) choose() *Variant {
+	var n int
+	if split.random != nil {
+		n = split.random.IntN(split.Total)
+	} else {
+		n = rand.IntN(split.Total)
+	}
+	for _, variant := range split.Variants {
+		if n < variant.Weight {
+			return variant
+		}
+		n -= variant.Weight
+	}
+	return split.Variants[len(split.Variants)-1]
+}
+
+// newSplit creates a Split from a comma separated list of "url:weight", each variant being a Proxy with the same
+// options
+func newSplit(value, cookie string, options ProxyOptions) (*Split, error) {
+	split := &Split{Cookie: cookie}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		colon := strings.LastIndexByte(entry, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("%q should be url:weight", entry)
+		}
+		weight, err := strconv.Atoi(entry[colon+1:])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%q should be url:weight, with a weight of 0 or more", entry)
+		}
+		to := entry[:colon]
+		proxy, err := newProxy(to, options)
+		if err != nil {
+			return nil, err
+		}
+		id := sha256.Sum256([]byte(to))
+		split.Variants = append(split.Variants, &Variant{To: to, Weight: weight, ID: hex.EncodeToString(id[:4]), Proxy: proxy})
+		split.Total += weight
+	}
+	if split.Total == 0 {
+		return nil, fmt.Errorf("the weights add up to 0")
+	}
+	return split, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// namedUpstream answers every request with its name, in an X-Variant header
+func namedUpstream(t *testing.T, name string) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("X-Variant", name)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestSplitCookieAfterEarlyHints(t *testing.T) {
+	split, err := newSplit(earlyHintsUpstream(t).URL+":1", "variant", ProxyOptions{ForwardedStyle: "x-forwarded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(split)
+	defer server.Close()
+
+	informational, response := getInformational(t, server.URL)
+	if len(informational) != 1 {
+		t.Fatalf("got %v ahead of the response, want the 103", informational)
+	}
+	cookies := response.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "variant" || cookies[0].Value != split.Variants[0].ID {
+		t.Errorf("after the 103, the response set %v", cookies)
+	}
+}
+
+func TestSplitSticky(t *testing.T) {
+	stable, canary := namedUpstream(t, "stable"), namedUpstream(t, "canary")
+	split, err := newSplit(stable.URL+":0, "+canary.URL+":1", "variant", ProxyOptions{ForwardedStyle: "x-forwarded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(split)
+	defer server.Close()
+	get := func(cookie *http.Cookie) *http.Response {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+		response, err := http.DefaultTransport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response
+	}
+
+	// a zero weight is never chosen
+	response := get(nil)
+	if variant := response.Header.Get("X-Variant"); variant != "canary" || len(response.Cookies()) != 1 {
+		t.Fatalf("got %q, setting %v", variant, response.Cookies())
+	}
+	cookie := response.Cookies()[0]
+	response = get(cookie)
+	if variant := response.Header.Get("X-Variant"); variant != "canary" || len(response.Cookies()) != 0 {
+		t.Errorf("with the cookie got %q, setting %v", variant, response.Cookies())
+	}
+	// nor is it kept to, once it's been weighted down to nothing
+	response = get(&http.Cookie{Name: "variant", Value: split.Variants[0].ID})
+	if variant := response.Header.Get("X-Variant"); variant != "canary" {
+		t.Errorf("with a cookie for the stable variant, at weight 0, got %q", variant)
+	}
+}
+
+func TestSplitSeeded(t *testing.T) {
+	choices := func(seed uint64) []string {
+		split, err := newSplit("http://stable:8080:95, http://canary:8080:5", "", ProxyOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		split.random = rand.New(rand.NewPCG(seed, 0))
+		var chosen []string
+		for i := 0; i < 1000; i++ {
+			chosen = append(chosen, split.choose().To)
+		}
+		return chosen
+	}
+
+	first := choices(1)
+	if !slices.Equal(first, choices(1)) {
+		t.Error("the same seed didn't make the same choices")
+	}
+	if slices.Equal(first, choices(2)) {
+		t.Error("a different seed made the same choices")
+	}
+	// the same every run for this seed, but any seed should come out near 5%
+	canary := 0
+	for _, to := range first {
+		if to == "http://canary:8080" {
+			canary++
+		}
+	}
+	if canary < 30 || canary > 70 {
+		t.Errorf("chose the canary %d times in 1000, with a weight of 5 in 100", canary)
+	}
+}
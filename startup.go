@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// --- Startup ---
+
+// proxies are every Proxy the rules use, templated ones included, however many share the same "to"
+func proxies(ruleSet *RuleSet) []*Proxy {
+	var proxies []*Proxy
+	add := func(proxy *Proxy) {
+		if proxy != nil {
+			proxies = append(proxies, proxy)
+		}
+	}
+	for _, hostRules := range ruleSet.Hosts {
+		for _, rule := range hostRules {
+			switch handler := rule.Handler.(type) {
+			case *Proxy:
+				add(handler)
+			case *Split:
+				for _, variant := range handler.Variants {
+					add(variant.Proxy)
+				}
+			case *NotFound:
+				add(handler.Fallback)
+			}
+		}
+	}
+	return proxies
+}
+
+// upstreams are every Proxy the rules use, by its "to", other than templated ones, which aren't known until a
+// request comes in
+func upstreams(ruleSet *RuleSet) map[string]*Proxy {
+	upstreams := make(map[string]*Proxy)
+	for _, proxy := range proxies(ruleSet) {
+		if proxy.Template == nil {
+			upstreams[proxy.To] = proxy
+		}
+	}
+	return upstreams
+}
+
+// upstreamAddresses are the host:port of every upstream the rules proxy to
+func upstreamAddresses(ruleSet *RuleSet) []string {
+	seen := make(map[string]bool)
+	for to := range upstreams(ruleSet) {
+		u, err := url.Parse(to)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		seen[net.JoinHostPort(u.Hostname(), port)] = true
+	}
+
+	addresses := make([]string, 0, len(seen))
+	for address := range seen {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// waitForUpstreams waits up to timeout for every upstream to take a connection, so we don't start answering
+// requests with 502s while they're still starting too. Any still down by then are logged and we carry on.
+func waitForUpstreams(ruleSet *RuleSet, timeout time.Duration) {
+	waiting := upstreamAddresses(ruleSet)
+	log.Printf("Waiting up to %v for %d upstream(s)\n", timeout, len(waiting))
+	deadline := time.Now().Add(timeout)
+	for {
+		var down []string
+		for _, address := range waiting {
+			conn, err := net.DialTimeout("tcp", address, time.Second)
+			if err != nil {
+				down = append(down, address)
+				continue
+			}
+			conn.Close()
+		}
+		waiting = down
+		if len(waiting) == 0 {
+			log.Println("All upstreams are up")
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Warning: starting anyway, %d upstream(s) still down: %v\n", len(waiting), waiting)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// testBackends makes a request to every upstream through its own transport, printing whether each is OK, which it
+// is if it answers with anything but a 5xx. It gives false if any aren't.
+func testBackends(ruleSet *RuleSet, timeout time.Duration) bool {
+	proxies := upstreams(ruleSet)
+	tos := make([]string, 0, len(proxies))
+	for to := range proxies {
+		tos = append(tos, to)
+	}
+	sort.Strings(tos)
+
+	failed := 0
+	for _, to := range tos {
+		status, took, err := testBackend(to, proxies[to].ReverseProxy.Transport, timeout)
+		switch {
+		case err != nil:
+			fmt.Printf("FAIL %v %v\n", to, err)
+			failed++
+		case status >= 500:
+			fmt.Printf("FAIL %v %d (%v)\n", to, status, took.Round(time.Millisecond))
+			failed++
+		default:
+			fmt.Printf("OK   %v %d (%v)\n", to, status, took.Round(time.Millisecond))
+		}
+	}
+	fmt.Printf("%d of %d backend(s) OK\n", len(tos)-failed, len(tos))
+	return failed == 0
+}
+
+// testBackend makes a HEAD request to the upstream, or a GET if it doesn't do HEAD
+func testBackend(to string, transport http.RoundTripper, timeout time.Duration) (int, time.Duration, error) {
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		// a redirect is an answer, whichever way it points
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	start := time.Now()
+	var response *http.Response
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		request, err := http.NewRequest(method, to, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		response, err = client.Do(request)
+		if err != nil {
+			return 0, 0, err
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusMethodNotAllowed && response.StatusCode != http.StatusNotImplemented {
+			break
+		}
+	}
+	return response.StatusCode, time.Since(start), nil
+}
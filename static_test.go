@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewStaticChecksDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file.txt")
+	os.WriteFile(file, []byte("not a dir"), 0644)
+
+	if _, err := newStatic(dir); err != nil {
+		t.Errorf("%v: %v", dir, err)
+	}
+	for _, missing := range []string{filepath.Join(dir, "typo"), file} {
+		static, err := newStatic(missing)
+		if err == nil {
+			t.Errorf("%v: no error", missing)
+		}
+		// it's still made, for when the problem is only a warning
+		if static == nil || static.Dir != missing {
+			t.Errorf("%v: got %+v", missing, static)
+		}
+	}
+}
+
+func TestStaticMissingDir(t *testing.T) {
+	files := map[string]string{"a.conf": "host = a.com\ntype = Static\ndir = " + filepath.Join(t.TempDir(), "typo") + "\n"}
+
+	logged := captureLog(t)
+	if _, errs := loadTestRules(t, files); len(errs) > 0 {
+		t.Errorf("a missing dir is only a warning without strict, got %v", errs)
+	}
+	if !strings.Contains(logged.String(), "Warning: Static(a.com)") {
+		t.Errorf("no warning logged, got %q", logged.String())
+	}
+
+	withSettings(t, func(settings *Settings) { settings.Strict = true })
+	_, errs := loadTestRules(t, files)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "dir") {
+		t.Errorf("with strict a missing dir should be a problem with dir, got %v", errs)
+	}
+}
+
+// rawGet sends the path exactly as it's given, which a client would clean up first, and gives the whole response
+func rawGet(t *testing.T, server *httptest.Server, path string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: a.com\r\nConnection: close\r\n\r\n")
+	response, _ := io.ReadAll(conn)
+	return string(response)
+}
+
+func TestStaticTraversal(t *testing.T) {
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("the secret"), 0644)
+	dir := filepath.Join(outside, "site")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "sub", "page.txt"), []byte("a page"), 0644)
+	static, err := newStatic(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := captureLog(t)
+	server := httptest.NewServer(static)
+	defer server.Close()
+
+	if response := rawGet(t, server, "/sub/page.txt"); !strings.Contains(response, "a page") {
+		t.Fatalf("the page inside dir isn't served, got %q", response)
+	}
+	for _, path := range []string{"/../secret.txt", "/sub/../../secret.txt", "/%2e%2e/secret.txt",
+		"/..%2fsecret.txt", "/sub/%2e%2e%2f%2e%2e%2fsecret.txt", "/..\\secret.txt"} {
+		if response := rawGet(t, server, path); strings.Contains(response, "the secret") {
+			t.Errorf("%v served the file outside dir", path)
+		}
+	}
+	// the path logged is the one served, which never has a way out of dir
+	if strings.Contains(logged.String(), "../") {
+		t.Errorf("logged a path with .. in it: %q", logged.String())
+	}
+}
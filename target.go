@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// --- Target Templates ---
+
+// placeholder is a {name} in a path or target
+var placeholder = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// segmentPattern is what a captured segment may be. Dots and the like are left out so a segment can't take the
+// target anywhere other than where the template says, e.g. "http://{name}.internal/" stays inside .internal.
+const segmentPattern = `[A-Za-z0-9_-]+`
+
+// TargetTemplate is a Proxy "to" with {name}s in it, filled in per request from the path segments of the same
+// names in the rule's path, e.g. "path = /svc/{name}/" with "to = http://{name}.internal/". The part of the path
+// the template matched is taken off before being passed on.
+type TargetTemplate struct {
+	To string
+	// Prefix is the literal start of the path, before the first {name}, for the rule to match on
+	Prefix  string
+	Pattern *regexp.Regexp
+}
+
+// newTargetTemplate checks every {name} in to is a whole segment of path, and that to makes a URL once filled in
+func newTargetTemplate(to, path string) (*TargetTemplate, error) {
+	captured := make(map[string]bool)
+	pattern := "^"
+	prefix := ""
+	for i, segment := range strings.Split(path, "/") {
+		if i > 0 {
+			pattern += "/"
+		}
+		if match := placeholder.FindStringSubmatch(segment); match != nil {
+			if match[0] != segment {
+				return nil, fmt.Errorf("%v in path must be a whole segment", match[0])
+			}
+			if captured[match[1]] {
+				return nil, fmt.Errorf("%v is in path more than once", match[0])
+			}
+			if len(captured) == 0 {
+				prefix = strings.SplitN(path, match[0], 2)[0]
+			}
+			captured[match[1]] = true
+			pattern += "(?P<" + match[1] + ">" + segmentPattern + ")"
+			continue
+		}
+		pattern += regexp.QuoteMeta(segment)
+	}
+	if len(captured) == 0 {
+		return nil, fmt.Errorf("path %q has no {name}s for %q to use", path, to)
+	}
+
+	for _, match := range placeholder.FindAllStringSubmatch(to, -1) {
+		if !captured[match[1]] {
+			return nil, fmt.Errorf("%v isn't in path %q", match[0], path)
+		}
+	}
+	example, err := url.Parse(placeholder.ReplaceAllString(to, "1"))
+	if err != nil {
+		return nil, err
+	}
+	if (example.Scheme != "http" && example.Scheme != "https") || example.Host == "" {
+		return nil, fmt.Errorf("%q must be an http or https URL", to)
+	}
+
+	return &TargetTemplate{To: to, Prefix: prefix, Pattern: regexp.MustCompile(pattern)}, nil
+}
+
+// Resolve fills in the template from the request's path, returning the upstream and the rest of the path, or false
+// if the path doesn't have the segments
+func (template *TargetTemplate) Resolve(path string) (*url.URL, string, bool) {
+	match := template.Pattern.FindStringSubmatch(path)
+	if match == nil {
+		return nil, "", false
+	}
+	to := placeholder.ReplaceAllStringFunc(template.To, func(name string) string {
+		return match[template.Pattern.SubexpIndex(name[1:len(name)-1])]
+	})
+	upstream, err := url.Parse(to)
+	if err != nil {
+		return nil, "", false
+	}
+	rest := path[len(match[0]):]
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return upstream, rest, true
+}
+
+// resolvedTarget is where a templated Proxy's request is going, worked out before the Director runs
+type resolvedTarget struct {
+	Upstream *url.URL
+	Path     string
+}
+
+// resolvedTargetKey is the context key holding the resolvedTarget
+type resolvedTargetKey struct{}
+
+// targetOf returns the request's resolvedTarget, or nil when the Proxy isn't templated
+func targetOf(request *http.Request) *resolvedTarget {
+	target, _ := request.Context().Value(resolvedTargetKey{}).(*resolvedTarget)
+	return target
+}
+
+// withTarget resolves the template for the request, giving false if its path doesn't fit
+func (template *TargetTemplate) withTarget(request *http.Request) (*http.Request, bool) {
+	upstream, rest, ok := template.Resolve(request.URL.Path)
+	if !ok {
+		return request, false
+	}
+	target := &resolvedTarget{Upstream: upstream, Path: rest}
+	return request.WithContext(context.WithValue(request.Context(), resolvedTargetKey{}, target)), true
+}
+
+// direct points the outbound request at its resolved target, as NewSingleHostReverseProxy's Director does for a
+// fixed one
+func (target *resolvedTarget) direct(request *http.Request) {
+	request.URL.Scheme = target.Upstream.Scheme
+	request.URL.Host = target.Upstream.Host
+	request.URL.Path = strings.TrimSuffix(target.Upstream.Path, "/") + target.Path
+	request.URL.RawPath = ""
+	switch {
+	case target.Upstream.RawQuery == "":
+	case request.URL.RawQuery == "":
+		request.URL.RawQuery = target.Upstream.RawQuery
+	default:
+		request.URL.RawQuery = target.Upstream.RawQuery + "&" + request.URL.RawQuery
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Timeouts ---
+
+// Timeouts override the server's read, write and request timeouts for a host. Nil leaves the server's in place and
+// zero means no timeout at all, e.g. for a long lived streaming host.
+type Timeouts struct {
+	Read    *time.Duration
+	Write   *time.Duration
+	Request *time.Duration
+}
+
+// apply sets this request's deadlines, counting from now, logging if the writer won't take them (which is one of
+// our writers missing an Unwrap)
+func (timeouts Timeouts) apply(writer http.ResponseWriter, request *http.Request) {
+	if timeouts.Read == nil && timeouts.Write == nil {
+		return
+	}
+	controller := http.NewResponseController(writer)
+	if timeouts.Read != nil {
+		if err := controller.SetReadDeadline(deadline(*timeouts.Read)); err != nil {
+			log.Printf("Error: Timeouts(%v): can't set the read timeout: %v\n", request.Host, err)
+		}
+	}
+	if timeouts.Write != nil {
+		if err := controller.SetWriteDeadline(deadline(*timeouts.Write)); err != nil {
+			log.Printf("Error: Timeouts(%v): can't set the write timeout: %v\n", request.Host, err)
+		}
+	}
+}
+
+// deadline is the time a timeout runs out, with zero meaning never
+func deadline(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// transferChunk is how much of a file is sent between each push of the deadline
+const transferChunk = 1 << 20
+
+// transferWriter pushes the write deadline back by its timeout each time some of the response is written, so the
+// deadline is for the client to keep reading rather than for the whole response
+type transferWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+	timeout    time.Duration
+}
+
+// newTransferWriter starts the first deadline, which also replaces any write_timeout the host has
+func newTransferWriter(writer http.ResponseWriter, request *http.Request, timeout time.Duration) *transferWriter {
+	w := &transferWriter{ResponseWriter: writer, controller: http.NewResponseController(writer), timeout: timeout}
+	if err := w.extend(); err != nil {
+		log.Printf("Error: Static(%v): can't set the transfer timeout: %v\n", request.Host, err)
+	}
+	return w
+}
+
+func (w *transferWriter) extend() error {
+	return w.controller.SetWriteDeadline(deadline(w.timeout))
+}
+
+func (w *transferWriter) Write(b []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom copies transferChunk at a time, pushing the deadline back before each, so a sendfile still has a
+// deadline to keep to
+func (w *transferWriter) ReadFrom(src io.Reader) (int64, error) {
+	// the FileServer hands over an io.LimitedReader of the file, which is only sent with a sendfile unwrapped
+	limit, limited := src.(*io.LimitedReader)
+	var total int64
+	for {
+		chunk := &io.LimitedReader{R: src, N: transferChunk}
+		if limited {
+			chunk = &io.LimitedReader{R: limit.R, N: min(limit.N, transferChunk)}
+		}
+		w.extend()
+		n, err := readFrom(w.ResponseWriter, chunk)
+		total += n
+		if limited {
+			limit.N -= n
+		}
+		if err != nil || n < transferChunk || (limited && limit.N <= 0) {
+			return total, err
+		}
+	}
+}
+
+func (w *transferWriter) Flush() {
+	w.extend()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *transferWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isStreaming says whether a request is for a websocket, event stream or gRPC call, which may go on and on
+func isStreaming(request *http.Request) bool {
+	return request.Header.Get("Upgrade") != "" || strings.Contains(request.Header.Get("Accept"), "text/event-stream") ||
+		strings.HasPrefix(request.Header.Get("Content-Type"), "application/grpc")
+}
+
+// requestTimeout is how long this request has to be served in, with zero meaning forever
+func (timeouts Timeouts) requestTimeout(request *http.Request) time.Duration {
+	if isStreaming(request) {
+		return 0
+	}
+	if timeouts.Request != nil {
+		return *timeouts.Request
+	}
+	return settings.RequestTimeout
+}
+
+// timeoutWriter stops passing on the response once the request's context has run out, and finish tells the client
+// if it has.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wroteHeader bool
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if w.ctx.Err() != nil && !w.wroteHeader {
+		// too late, finish will send the 504
+		return
+	}
+	if code >= 200 {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutWriter) ReadFrom(src io.Reader) (int64, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	w.wroteHeader = true
+	return readFrom(w.ResponseWriter, src)
+}
+
+func (w *timeoutWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *timeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends a 504 if we ran out of time before any of the response went out
+func (w *timeoutWriter) finish(request *http.Request) {
+	if !errors.Is(w.ctx.Err(), context.DeadlineExceeded) || w.wroteHeader {
+		return
+	}
+	log.Printf("Timed Out(%v) %v\n", request.Host, logURI(request))
+	for name := range w.Header() {
+		delete(w.Header(), name)
+	}
+	w.wroteHeader = true
+	http.Error(w.ResponseWriter, "Gateway Timeout", http.StatusGatewayTimeout)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog has the standard logger write to a buffer for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return &buffer
+}
+
+// slowText waits, then writes a compressible body big enough not to fit in the socket's buffers
+func slowText(wait time.Duration) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		time.Sleep(wait)
+		writer.Header().Set("Content-Type", "text/plain")
+		for i := 0; i < 64; i++ {
+			if _, err := io.WriteString(writer, strings.Repeat("x", 64<<10)); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// getGzip gets the URL as a client which takes gzip, giving the error (if any) from reading the whole response
+func getGzip(url string) error {
+	request, _ := http.NewRequest("GET", url, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(io.Discard, response.Body)
+	return err
+}
+
+func TestWriteTimeoutWithCompression(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	logged := captureLog(t)
+	rule := &Rule{Handler: slowText(200 * time.Millisecond), Compression: &testCompression,
+		Timeouts: Timeouts{Write: &timeout}}
+	server := httptest.NewServer(rule)
+	defer server.Close()
+
+	if err := getGzip(server.URL); err == nil {
+		t.Error("the response was written long after the write timeout")
+	}
+	if strings.Contains(logged.String(), "can't set") {
+		t.Errorf("logged %q", logged.String())
+	}
+}
+
+func TestTimeoutsLogWhenUnsupported(t *testing.T) {
+	timeout := time.Second
+	logged := captureLog(t)
+	// a ResponseRecorder has no connection to set deadlines on
+	Timeouts{Read: &timeout, Write: &timeout}.apply(httptest.NewRecorder(), httptest.NewRequest("GET", "http://a.com/", nil))
+	for _, want := range []string{"can't set the read timeout", "can't set the write timeout"} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("%q isn't logged, got %q", want, logged.String())
+		}
+	}
+}
+
+// getStalled gets the path as a client which takes gzip but doesn't read any of the response for stall, giving the
+// response's encoding and the error (if any) from then reading the body
+func getStalled(t *testing.T, server *httptest.Server, path string, stall time.Duration) (string, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: a.com\r\nAccept-Encoding: gzip\r\n\r\n")
+	time.Sleep(stall)
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(io.Discard, response.Body)
+	return response.Header.Get("Content-Encoding"), err
+}
+
+func TestTransferTimeoutWithCompression(t *testing.T) {
+	// random text compresses by only a quarter, so plenty of it is left over once the socket's buffers are full
+	random := make([]byte, 24<<20)
+	rand.Read(random)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "big.txt"), []byte(base64.StdEncoding.EncodeToString(random)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	static, err := newStatic(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	static.TransferTimeout = 100 * time.Millisecond
+	logged := captureLog(t)
+	server := httptest.NewServer(&Rule{Handler: static, Compression: &testCompression})
+	defer server.Close()
+
+	encoding, err := getStalled(t, server, "/big.txt", 0)
+	if encoding != "gzip" || err != nil {
+		t.Errorf("reading steadily got a %q encoded response, %v", encoding, err)
+	}
+	if _, err := getStalled(t, server, "/big.txt", 500*time.Millisecond); err == nil {
+		t.Error("a client which stopped reading for longer than the transfer timeout got the whole response")
+	}
+	if strings.Contains(logged.String(), "can't set") {
+		t.Errorf("logged %q", logged.String())
+	}
+}
+
+// ticker streams a line every interval, count times, as an event stream would
+func ticker(interval time.Duration, count int) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < count; i++ {
+			if _, err := io.WriteString(writer, "data: tick\n\n"); err != nil {
+				return
+			}
+			http.NewResponseController(writer).Flush()
+			time.Sleep(interval)
+		}
+	})
+}
+
+func TestHostWriteTimeoutOverridesServer(t *testing.T) {
+	none := time.Duration(0)
+	for _, write := range []*time.Duration{nil, &none} {
+		server := httptest.NewUnstartedServer(&Rule{Handler: ticker(50*time.Millisecond, 8), Timeouts: Timeouts{Write: write}})
+		server.Config.WriteTimeout = 100 * time.Millisecond
+		server.Start()
+		defer server.Close()
+
+		response, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		ticks := strings.Count(string(body), "tick")
+		if write == nil && ticks == 8 {
+			t.Error("the server's write timeout didn't cut off a stream with no override")
+		}
+		if write != nil && (ticks != 8 || err != nil) {
+			t.Errorf("a host with no write timeout got %d of 8 ticks, %v", ticks, err)
+		}
+	}
+}
+
+func TestTransferTimeoutOnDefaultFile(t *testing.T) {
+	favicon := filepath.Join(t.TempDir(), "favicon.ico")
+	os.WriteFile(favicon, []byte("an icon"), 0644)
+	saved := defaultFiles
+	defaultFiles = map[string]string{"/favicon.ico": favicon}
+	t.Cleanup(func() { defaultFiles = saved })
+	static, err := newStatic(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	static.TransferTimeout = time.Second
+	logged := captureLog(t)
+	server := httptest.NewServer(&Rule{Handler: static, Defaults: true})
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/favicon.ico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || string(body) != "an icon" {
+		t.Errorf("got %v %q, want the default favicon", response.Status, body)
+	}
+	if strings.Contains(logged.String(), "can't set") {
+		t.Errorf("logged %q", logged.String())
+	}
+}
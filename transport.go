@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// --- Upstream Transport ---
+
+// TransportOptions tune how a Proxy connects to its upstream. Anything nil or unset keeps http.DefaultTransport's
+// behaviour, given with each.
+type TransportOptions struct {
+	// DialTimeout (dial_timeout, default 30s) is how long connecting to the upstream may take.
+	DialTimeout *time.Duration
+	// SourceAddress (source_address, default the OS's choice) is the local IP connections to the upstream are made
+	// from, for upstreams which only allow certain IPs on a box with several.
+	SourceAddress *net.TCPAddr
+	// TLSHandshakeTimeout (tls_handshake_timeout, default 10s) is how long an https upstream's handshake may take.
+	TLSHandshakeTimeout *time.Duration
+	// ExpectContinueTimeout (expect_continue_timeout, default 1s) is how long a request with "Expect:
+	// 100-continue" waits for the upstream's 100 Continue before its body is sent anyway. Zero sends it at once.
+	ExpectContinueTimeout *time.Duration
+	// DisableCompression (disable_compression, default off) stops the transport asking the upstream for gzip
+	// when the client didn't.
+	DisableCompression bool
+	// IdleConnTimeout (idle_conn_timeout, default 90s) is how long a connection to the upstream is kept idle before
+	// it's closed. Keep it shorter than the idle timeout of any firewall on the way, which otherwise resets the
+	// connection under the next request.
+	IdleConnTimeout *time.Duration
+	// DisableKeepAlives (disable_keep_alives, default off) uses a new connection to the upstream for every request,
+	// for upstreams which drop idle connections without warning.
+	DisableKeepAlives bool
+	// OutboundProxy (outbound_proxy, default from $HTTP_PROXY, $HTTPS_PROXY and $NO_PROXY) is a proxy to reach
+	// the upstream through.
+	OutboundProxy *url.URL
+	// GRPC talks HTTP/2 to the upstream, without TLS (h2c) when it's plain http.
+	GRPC bool
+}
+
+// isLocalIP says whether the IP is one of this machine's, so connections can be made from it
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDefault says whether the options leave everything as http.DefaultTransport has it
+func (options TransportOptions) isDefault() bool {
+	return options == TransportOptions{}
+}
+
+// newTransport makes the transport to an upstream, sharing http.DefaultTransport (and its idle connections) when
+// there's nothing to change
+func newTransport(upstream *url.URL, options TransportOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport)
+	if options.isDefault() {
+		return transport
+	}
+	transport = transport.Clone()
+
+	if options.DialTimeout != nil || options.SourceAddress != nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		if options.DialTimeout != nil {
+			dialer.Timeout = *options.DialTimeout
+		}
+		dialer.LocalAddr = options.SourceAddress
+		transport.DialContext = dialer.DialContext
+	}
+	if options.TLSHandshakeTimeout != nil {
+		transport.TLSHandshakeTimeout = *options.TLSHandshakeTimeout
+	}
+	if options.ExpectContinueTimeout != nil {
+		transport.ExpectContinueTimeout = *options.ExpectContinueTimeout
+	}
+	transport.DisableCompression = options.DisableCompression
+	if options.IdleConnTimeout != nil {
+		transport.IdleConnTimeout = *options.IdleConnTimeout
+	}
+	transport.DisableKeepAlives = options.DisableKeepAlives
+	if options.OutboundProxy != nil {
+		transport.Proxy = http.ProxyURL(options.OutboundProxy)
+	}
+	if options.GRPC {
+		transport.Protocols = new(http.Protocols)
+		if upstream.Scheme == "https" {
+			transport.Protocols.SetHTTP2(true)
+		} else {
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+	return transport
+}
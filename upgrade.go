@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Binary Upgrades ---
+
+// With graceful_upgrade on, a SIGUSR2 starts the zproxy binary afresh (so whatever is at its path now, e.g. a new
+// version) with the same arguments, handing it our listening sockets. Once it's loaded its config and is serving
+// on them it says so, and we stop accepting and shut down as we would on a SIGTERM, finishing the requests we're
+// in the middle of. Connections are never refused, as the sockets stay open throughout. If the new one fails to
+// start, or takes longer than upgradeTimeout, we carry on as we were.
+//
+// The limitations:
+//   - the new process is our child, so whatever started us (e.g. systemd) needs to be happy with the main process
+//     changing, e.g. with a PIDFile, or it may stop the new one when we exit
+//   - the new one runs as whoever we are, so once privileges have been dropped it can only read what that user can
+//     (such as the certificates' keys), and can't bind anything new, e.g. if tls_address has changed
+//   - settings which are about the sockets, such as reuse_port and listen_backlog, stay as they were
+//   - a gzipped access log is closed as we hand over, so the lines for requests we finish after that are lost,
+//     rather than the two of us interleaving gzip members
+
+// upgradeTimeout is how long the new process has to start serving before we give up on it
+const upgradeTimeout = 30 * time.Second
+
+// upgradeEnv says which of the sockets handed to a new process (from fd 4 on, fd 3 being for saying it's ready) are
+// which, as a comma separated "http" or "https" for each
+const upgradeEnv = "ZPROXY_UPGRADE_FDS"
+
+// upgradeReadyFd is the pipe the new process closes once it's serving
+const upgradeReadyFd = 3
+
+// inheritedListeners returns the sockets handed over by the process we're taking over from, along with the one for
+// HTTPS (if there is one), or none if we weren't started that way
+func inheritedListeners() ([]net.Listener, net.Listener, error) {
+	kinds := os.Getenv(upgradeEnv)
+	if kinds == "" {
+		return nil, nil, nil
+	}
+	// they're only meant for us, not any we start in turn
+	os.Unsetenv(upgradeEnv)
+
+	var listeners []net.Listener
+	var tlsListener net.Listener
+	for i, kind := range strings.Split(kinds, ",") {
+		fd := upgradeReadyFd + 1 + i
+		file := os.NewFile(uintptr(fd), "UPGRADE_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("upgrade fd %d: %v", fd, err)
+		}
+		listeners = append(listeners, listener)
+		if kind == "https" {
+			tlsListener = listener
+		}
+	}
+	return listeners, tlsListener, nil
+}
+
+// upgraded tells the process we're taking over from that we're serving, if there is one
+func upgraded() {
+	pipe := os.NewFile(upgradeReadyFd, "UPGRADE_READY")
+	if _, err := pipe.Write([]byte("ready")); err != nil {
+		log.Println("Upgrade:", err)
+	}
+	pipe.Close()
+}
+
+// handover is what a SIGUSR2 needs to hand our sockets over, and to keep track of the connections we've accepted
+// which are still to send their first request. Once the server is shutting down those are closed unanswered as
+// soon as their request comes in, so we wait for them before shutting down.
+type handover struct {
+	listeners []*pausableListener
+	// tls is the (unwrapped) HTTPS listener, if there is one
+	tls net.Listener
+
+	mu    sync.Mutex
+	fresh map[net.Conn]bool
+}
+
+func newHandover(tlsListener net.Listener) *handover {
+	return &handover{tls: tlsListener, fresh: make(map[net.Conn]bool)}
+}
+
+// wrap has the listener's accepting stopped when we hand over, so it needs to go around the bare listener
+func (handover *handover) wrap(listener net.Listener) net.Listener {
+	pausable := &pausableListener{Listener: listener, paused: make(chan struct{}), stopped: make(chan struct{}),
+		closed: make(chan struct{})}
+	handover.listeners = append(handover.listeners, pausable)
+	return pausable
+}
+
+// connState is the server's ConnState, noting which connections haven't sent a request yet
+func (handover *handover) connState(conn net.Conn, state http.ConnState) {
+	handover.mu.Lock()
+	defer handover.mu.Unlock()
+	if state == http.StateNew {
+		handover.fresh[conn] = true
+	} else {
+		delete(handover.fresh, conn)
+	}
+}
+
+// waitForFresh waits, for at most timeout, until every connection we've accepted has sent its first request. The
+// listeners must have been paused.
+func (handover *handover) waitForFresh(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	// a connection the server has only just accepted isn't new to it until it's back for another
+	for _, listener := range handover.listeners {
+		select {
+		case <-listener.stopped:
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+	for time.Now().Before(deadline) {
+		handover.mu.Lock()
+		fresh := len(handover.fresh)
+		handover.mu.Unlock()
+		if fresh == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pausableListener stops accepting once paused, leaving the socket open for whoever we've handed it to, until
+// it's closed
+type pausableListener struct {
+	net.Listener
+	paused    chan struct{}
+	stopped   chan struct{}
+	closed    chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+func (l *pausableListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.paused:
+			l.stopOnce.Do(func() { close(l.stopped) })
+			<-l.closed
+			return nil, net.ErrClosed
+		default:
+		}
+	}
+	return conn, err
+}
+
+// pause stops Accept taking any more connections, including one it's in the middle of waiting for
+func (l *pausableListener) pause() {
+	close(l.paused)
+	// the deadline is this process's, not the socket's, so the new process carries on accepting
+	if deadliner, ok := l.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+		deadliner.SetDeadline(time.Now())
+	}
+}
+
+func (l *pausableListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// upgrade starts our binary afresh with the listeners, waiting for it to say it's serving, and gives its pid
+func upgrade(handover *handover) (int, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	log.Println("Received SIGUSR2, upgrading to", binary)
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	files := []*os.File{readyWriter}
+	kinds := make([]string, len(handover.listeners))
+	for i, listener := range handover.listeners {
+		file, err := listener.Listener.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			readyWriter.Close()
+			return 0, err
+		}
+		defer file.Close()
+		files = append(files, file)
+		kinds[i] = "http"
+		if listener.Listener == handover.tls {
+			kinds[i] = "https"
+		}
+	}
+
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(kinds, ","))
+	err = cmd.Start()
+	// only the new process should hold the writing end, so we see it close if that dies
+	readyWriter.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, len("ready"))
+		n, _ := ready.Read(buffer)
+		if string(buffer[:n]) != "ready" {
+			result <- fmt.Errorf("pid %d stopped before it was serving", cmd.Process.Pid)
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("pid %d didn't start serving within %v", cmd.Process.Pid, upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+	// it's on its own now, we won't be around to wait for it
+	go cmd.Wait()
+	return cmd.Process.Pid, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// upgradeOnSignal can't be told to upgrade on this platform, which has no SIGUSR2 (nor passes sockets on to a child)
+func upgradeOnSignal(server *http.Server, handover *handover, done func()) {
+	log.Println("Warning: graceful_upgrade is only supported on Unix, no SIGUSR2 to upgrade with")
+}
@@ -0,0 +1,47 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// upgradeOnSignal starts a new process to take over from us each time we get a SIGUSR2, and once one has, shuts
+// the server down and calls done
+func upgradeOnSignal(server *http.Server, handover *handover, done func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	for range signals {
+		pid, err := upgrade(handover)
+		if err != nil {
+			log.Println("Not upgrading:", err)
+			continue
+		}
+		signal.Stop(signals)
+
+		log.Printf("Upgraded, pid %d is serving now, shutting down within %v\n", pid, settings.ShutdownTimeout)
+		for _, listener := range handover.listeners {
+			listener.pause()
+		}
+		// Shutdown closes them as idle after 5s anyway
+		handover.waitForFresh(5 * time.Second)
+		if accessLog != nil && accessLog.Compress {
+			if err := accessLog.Close(); err != nil {
+				log.Println("Access log:", err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), settings.ShutdownTimeout)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("Shutdown:", err)
+		}
+		cancel()
+		done()
+		return
+	}
+}
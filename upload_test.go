@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectContinue sends an upload asking for a 100 Continue first, and only sends the body if it gets one. It gives
+// whether the body was sent, and the final response.
+func expectContinue(t *testing.T, server *httptest.Server, body string) (bool, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "PUT /bucket/key HTTP/1.1\r\nHost: a.com\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", len(body))
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusContinue {
+		return false, response
+	}
+	io.WriteString(conn, body)
+	response, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return true, response
+}
+
+func TestProxyExpectContinue(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Expect") != "100-continue" {
+			http.Error(writer, "no Expect", http.StatusBadRequest)
+			return
+		}
+		if request.ContentLength > 10 {
+			// refused before reading any of it, so no 100 Continue is sent
+			http.Error(writer, "too big", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := io.ReadAll(request.Body)
+		fmt.Fprintf(writer, "stored %s", body)
+	}))
+	t.Cleanup(upstream.Close)
+	wait := 5 * time.Second
+	proxy := testProxy(t, upstream, ProxyOptions{Transport: TransportOptions{ExpectContinueTimeout: &wait}})
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	sent, response := expectContinue(t, server, "small")
+	body, _ := io.ReadAll(response.Body)
+	if !sent || response.StatusCode != http.StatusOK || string(body) != "stored small" {
+		t.Errorf("sent the body %v, got %v %q", sent, response.Status, body)
+	}
+
+	sent, response = expectContinue(t, server, strings.Repeat("big", 100))
+	if sent || response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("sent the body %v, got %v, want the upstream's 413 before sending it", sent, response.Status)
+	}
+}
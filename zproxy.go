@@ -1,30 +1,66 @@
 package main
 
 import (
-	"io/ioutil"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-
-	"github.com/Unknwon/goconfig"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// configDir is a directory to load all the config files from.
-var configDir = "/etc/zproxy.d"
-
 // Info: http://www.darul.io/post/2015-07-22_go-lang-simple-reverse-proxy
 
 // --- Redirect ---
 
 type Redirect struct {
 	To string
+	// Scheme, when set, replaces To's scheme with "https" or "http", or the request's own with "preserve"
+	Scheme string
+	// CacheControl and Expires, when set, bound how long browsers keep the redirect, which for a 301 is otherwise
+	// forever
+	CacheControl string
+	Expires      *time.Duration
 	http.Handler
 }
 
 func (redirect *Redirect) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	log.Printf("Redirecting(%v) %v\n", request.Host, redirect.To)
-	http.Redirect(writer, request, redirect.To+request.RequestURI, 301)
+	to := redirect.To
+	if redirect.Scheme == "preserve" {
+		to = withScheme(to, requestScheme(request))
+	}
+	dispatchf(request, "Redirecting(%v) %v\n", request.Host, to)
+	if redirect.CacheControl != "" {
+		writer.Header().Set("Cache-Control", redirect.CacheControl)
+	}
+	if redirect.Expires != nil {
+		writer.Header().Set("Expires", time.Now().Add(*redirect.Expires).UTC().Format(http.TimeFormat))
+	}
+	http.Redirect(writer, request, to+request.RequestURI, 301)
+}
+
+// withScheme gives to with its scheme swapped for the given one, or added if to is just "//host" or "host"
+func withScheme(to, scheme string) string {
+	if i := strings.Index(to, "://"); i >= 0 {
+		to = to[i+len("://"):]
+	} else {
+		to = strings.TrimPrefix(to, "//")
+	}
+	return scheme + "://" + to
 }
 
 // --- Static ---
@@ -32,12 +68,51 @@ func (redirect *Redirect) ServeHTTP(writer http.ResponseWriter, request *http.Re
 type Static struct {
 	Dir string
 	http.Handler
+	// CSP, when set, is the Content-Security-Policy to send with HTML, which gets a new nonce every request
+	CSP string
+	// Languages, when set, serves each client the subdirectory for its language
+	Languages *Languages
+	// OpaqueErrors turns every error serving a file into a 404
+	OpaqueErrors bool
+	// DirCheck, when set, serves a 503 while Dir is missing
+	DirCheck *DirCheck
+	// TransferTimeout, when set, is how long a response may go without any of it being written before the client is
+	// cut off, so a large download can take as long as it needs while a stalled one can't hang on forever
+	TransferTimeout time.Duration
+	// RemoveHeaders are deleted from responses, and then ResponseHeaders set
+	RemoveHeaders   []string
+	ResponseHeaders []HeaderTemplate
 }
 
 func (static *Static) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	path := request.URL.Path[1:]
-	log.Printf("Serving(%v) %v%v\n", request.Host, static.Dir, path)
-	http.ServeFile(writer, request, static.Dir+path)
+	if static.Languages != nil {
+		request = static.Languages.localise(writer, request)
+	}
+	// the FileServer only ever opens files via http.Dir, which cleans the path so it can't climb out of Dir
+	served := path.Clean("/" + request.URL.Path)
+	if settings.LogURI == "none" {
+		served = ""
+	}
+	if len(static.RemoveHeaders) > 0 || len(static.ResponseHeaders) > 0 {
+		writer = &responseHeaderWriter{ResponseWriter: writer, request: request, remove: static.RemoveHeaders,
+			templates: static.ResponseHeaders}
+	}
+	if static.DirCheck != nil && !static.DirCheck.available() {
+		static.DirCheck.serveUnavailable(writer)
+		return
+	}
+	dispatchf(request, "Serving(%v) %v %v\n", request.Host, static.Dir, served)
+	if static.TransferTimeout > 0 {
+		writer = newTransferWriter(writer, request, static.TransferTimeout)
+	}
+	if static.OpaqueErrors {
+		writer = &opaqueErrorWriter{ResponseWriter: writer}
+	}
+	if static.CSP != "" {
+		serveWithNonce(static.Handler, static.CSP, writer, request)
+		return
+	}
+	static.Handler.ServeHTTP(writer, request)
 }
 
 // --- Proxy ---
@@ -45,67 +120,684 @@ func (static *Static) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 type Proxy struct {
 	To           string
 	ReverseProxy *httputil.ReverseProxy
+	// Template, when "to" has {name}s in it, works out each request's upstream from its path
+	Template *TargetTemplate
+	// OptionsAllow, when set, is the Allow header for answering OPTIONS requests ourselves, not passing them on
+	OptionsAllow string
+	// GetBody is what's done with a GET or HEAD which has a body: "pass" it on, "strip" the body or "reject" it
+	GetBody string
+	// Idempotency, when set, gives a request with the same Idempotency-Key as an earlier one that one's response
+	Idempotency *Idempotency
+	// DropInformational keeps the upstream's 1xx responses, e.g. 103 Early Hints, from the client
+	DropInformational bool
+	// Mirror, when set, sends a copy of each request to a shadow upstream
+	Mirror *Mirror
+}
+
+// getBodies are what get_body may be
+var getBodies = []string{"pass", "strip", "reject"}
+
+// hasGetBody says whether the request is a GET or HEAD with a body, which has no meaning and some backends choke on
+func hasGetBody(request *http.Request) bool {
+	return (request.Method == http.MethodGet || request.Method == http.MethodHead) && request.ContentLength != 0
 }
 
 func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	log.Printf("Proxying(%v) %v%v\n", request.Host, proxy.To, request.RequestURI)
+	if proxy.OptionsAllow != "" && request.Method == http.MethodOptions {
+		dispatchf(request, "Options(%v) %v\n", request.Host, logURI(request))
+		writer.Header().Set("Allow", proxy.OptionsAllow)
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if proxy.GetBody == "reject" && hasGetBody(request) {
+		log.Printf("Body On %v(%v) %v\n", request.Method, request.Host, logURI(request))
+		http.Error(writer, "Bad Request: "+request.Method+" with a body", http.StatusBadRequest)
+		return
+	}
+	if proxy.Template != nil {
+		var ok bool
+		if request, ok = proxy.Template.withTarget(request); !ok {
+			log.Printf("No Target(%v) %v\n", request.Host, logURI(request))
+			http.NotFound(writer, request)
+			return
+		}
+		dispatchf(request, "Proxying(%v) %v %v\n", request.Host, targetOf(request).Upstream, logURI(request))
+	} else {
+		dispatchf(request, "Proxying(%v) %v%v\n", request.Host, proxy.To, logURI(request))
+	}
+	// keep hold of the inbound request so the Director and ModifyResponse can see it as the client sent it
+	request = request.WithContext(context.WithValue(request.Context(), inboundRequestKey{}, request))
+	if proxy.Idempotency != nil {
+		proxy.Idempotency.serve(http.HandlerFunc(proxy.forward), writer, request)
+		return
+	}
+	proxy.forward(writer, request)
+}
+
+// forward passes the request on to the upstream, noting how long it took for the access log
+func (proxy *Proxy) forward(writer http.ResponseWriter, request *http.Request) {
+	if statusWriter := findStatusWriter(writer); statusWriter != nil {
+		start := time.Now()
+		defer func() {
+			took := time.Since(start)
+			statusWriter.upstream = &took
+		}()
+	}
+	if proxy.Mirror != nil {
+		proxy.Mirror.send(request)
+	}
+	if proxy.DropInformational {
+		writer = &informationalDropper{ResponseWriter: writer}
+	}
 	proxy.ReverseProxy.ServeHTTP(writer, request)
 }
 
+// informationalDropper drops 1xx responses, other than the 101 an upgrade needs
+type informationalDropper struct {
+	http.ResponseWriter
+}
+
+func (w *informationalDropper) WriteHeader(code int) {
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *informationalDropper) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *informationalDropper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// TimingTransport puts the time the upstream took to respond, in seconds, in the X-Upstream-Time header.
+type TimingTransport struct {
+	http.RoundTripper
+}
+
+func (transport *TimingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := transport.RoundTripper.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Header.Set("X-Upstream-Time", fmt.Sprintf("%.3f", time.Since(start).Seconds()))
+	return response, nil
+}
+
+// proxyError is what the ReverseProxy does by default when it can't get a response from the upstream, except
+// that running out of time is a 504
+func proxyError(writer http.ResponseWriter, request *http.Request, err error) {
+	log.Printf("Proxy Error(%v) %v\n", request.Host, err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		writer.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	writer.WriteHeader(http.StatusBadGateway)
+}
+
+// inboundRequestKey is the context key holding the request as it arrived from the client.
+type inboundRequestKey struct{}
+
+// inboundRequest returns the client's original request, or the given request if there is none.
+func inboundRequest(request *http.Request) *http.Request {
+	if inbound, ok := request.Context().Value(inboundRequestKey{}).(*http.Request); ok {
+		return inbound
+	}
+	return request
+}
+
+// --- Header Templates ---
+
+// HeaderTemplate is a header whose value may reference parts of the request, i.e. "{host}", "{path}",
+// "{header.Name}" or "{cookie.Name}". References which can't be resolved become the empty string.
+type HeaderTemplate struct {
+	Name  string
+	Value string
+}
+
+var templateRef = regexp.MustCompile(`\{([a-z]+)(?:\.([^}]+))?\}`)
+
+// Resolve returns the header value for this particular request.
+func (tmpl HeaderTemplate) Resolve(request *http.Request) string {
+	return templateRef.ReplaceAllStringFunc(tmpl.Value, func(ref string) string {
+		match := templateRef.FindStringSubmatch(ref)
+		switch match[1] {
+		case "host":
+			return request.Host
+		case "path":
+			return request.URL.Path
+		case "header":
+			return request.Header.Get(match[2])
+		case "cookie":
+			cookie, err := request.Cookie(match[2])
+			if err != nil {
+				return ""
+			}
+			return cookie.Value
+		}
+		return ""
+	})
+}
+
+// setHeaders resolves each template against the request and sets it in the header.
+func setHeaders(header http.Header, templates []HeaderTemplate, request *http.Request) {
+	for _, tmpl := range templates {
+		header.Set(tmpl.Name, tmpl.Resolve(request))
+	}
+}
+
+// --- Files ---
+
+// Files serves individual files for individual paths, e.g. "/ads.txt", without exposing a whole directory.
+type Files struct {
+	Files map[string]string
+}
+
+func (files *Files) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	file, ok := files.Files[request.URL.Path]
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	dispatchf(request, "Serving(%v) %v\n", request.Host, file)
+	http.ServeFile(writer, request, file)
+}
+
+// --- Respond ---
+
+// Respond serves the same fixed response to every request, for a stub or a well-known file such as ads.txt with no
+// file or backend behind it
+type Respond struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+func (respond *Respond) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	dispatchf(request, "Responding(%v) %d %v\n", request.Host, respond.Status, logURI(request))
+	// unset, net/http sniffs it from the body
+	if respond.ContentType != "" {
+		writer.Header().Set("Content-Type", respond.ContentType)
+	}
+	if bodyAllowed(respond.Status) {
+		writer.Header().Set("Content-Length", strconv.Itoa(len(respond.Body)))
+	}
+	writer.WriteHeader(respond.Status)
+	writer.Write(respond.Body)
+}
+
+// bodyAllowed says whether a response with the status may have a body, which 1xxs, 204s and 304s can't
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
 // --- NotFound ---
 
 type NotFound struct {
 	http.Handler
+	// Fallback, when set, proxies the requests to an upstream in place of the 404, e.g. to the old site for the
+	// paths not yet moved off it
+	Fallback *Proxy
 }
 
 func (notFound *NotFound) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	log.Printf("Not Found(%v) %v\n", request.Host, request.RequestURI)
+	if notFound.Fallback != nil {
+		dispatchf(request, "Fallback(%v) %v\n", request.Host, logURI(request))
+		notFound.Fallback.ServeHTTP(writer, request)
+		return
+	}
+	dispatchf(request, "Not Found(%v) %v\n", request.Host, logURI(request))
 	notFound.Handler.ServeHTTP(writer, request)
 }
 
-// -- our structs to hold all of these things
+// --- Defaults ---
+
+// defaultFiles maps request paths to the files served when a host's own handler would 404
+var defaultFiles = make(map[string]string)
+
+// notFoundInterceptor swallows a 404 response so that something else can be served in its place
+type notFoundInterceptor struct {
+	http.ResponseWriter
+	notFound bool
+}
+
+func (w *notFoundInterceptor) WriteHeader(code int) {
+	if code == http.StatusNotFound {
+		w.notFound = true
+		// drop whatever the handler set up for its own 404
+		for name := range w.Header() {
+			delete(w.Header(), name)
+		}
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *notFoundInterceptor) Write(b []byte) (int, error) {
+	if w.notFound {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *notFoundInterceptor) ReadFrom(src io.Reader) (int64, error) {
+	if w.notFound {
+		return io.Copy(io.Discard, src)
+	}
+	return readFrom(w.ResponseWriter, src)
+}
+
+func (w *notFoundInterceptor) Flush() {
+	if w.notFound {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *notFoundInterceptor) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// serveWithDefaults serves the request with handler, unless it 404s on a path we have a default file for
+func serveWithDefaults(handler http.Handler, writer http.ResponseWriter, request *http.Request) {
+	file, ok := defaultFiles[request.URL.Path]
+	if !ok {
+		handler.ServeHTTP(writer, request)
+		return
+	}
+
+	interceptor := &notFoundInterceptor{ResponseWriter: writer}
+	handler.ServeHTTP(interceptor, request)
+	if interceptor.notFound {
+		dispatchf(request, "Default(%v) %v\n", request.Host, file)
+		http.ServeFile(writer, request, file)
+	}
+}
 
-var redirect map[string]Redirect
-var proxy map[string]Proxy
-var notFound map[string]NotFound
-var static map[string]Static
 var genericNotFound = http.NotFoundHandler()
 
-// factory to create and add a notFound handler
-func addNotFound(host string) {
-	log.Println("Adding host to notFound:", host)
-	notFound[host] = NotFound{
+// unknownHostNotFound is served for hosts we know nothing about, which is the genericNotFound unless there's a
+// default_not_found_page or unknown_host_status
+var unknownHostNotFound = genericNotFound
+
+// unknownHostRoot, when there's an unknown_host_root, answers a GET or HEAD of / at a host we don't know
+var unknownHostRoot *Respond
+
+// NotFoundPage serves a page of HTML as a 404, or as Status if it's set.
+type NotFoundPage struct {
+	Page   []byte
+	Status int
+}
+
+func (page *NotFoundPage) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	status := page.Status
+	if status == 0 {
+		status = http.StatusNotFound
+	}
+	if page.Page == nil {
+		http.Error(writer, http.StatusText(status), status)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(status)
+	writer.Write(page.Page)
+}
+
+// closeConnection drops the client's connection without a response, as nginx's 444 does. HTTP/2 can't be hijacked,
+// so there it's just the stream which is reset.
+func closeConnection(writer http.ResponseWriter, request *http.Request) {
+	if statusWriter := findStatusWriter(writer); statusWriter != nil {
+		statusWriter.status = 444
+	}
+	conn, _, err := http.NewResponseController(writer).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
+
+// --- Rules ---
+
+// Rule is what one config file says to do with (some of) a host's requests. A host may have several rules, e.g.
+// Static for "/static/", Proxy for "/api/" and a Redirect for everything else.
+type Rule struct {
+	Type   string
+	Target string
+	// Prefix and Pattern limit which paths the rule matches, the empty prefix and a nil pattern matching all. The
+	// path is passed on as it is, not with the prefix taken off. When there are Paths the path must also be one.
+	Prefix  string
+	Pattern *regexp.Regexp
+	Paths   map[string]bool
+	Handler http.Handler
+	// Defaults is whether the default files may be served in place of a 404 from the Handler
+	Defaults    bool
+	Compression *Compression
+	Timeouts    Timeouts
+	// BodyLogging, when on, logs the bodies going through the rule, for debugging
+	BodyLogging *BodyLogging
+	// ConnectionClose closes the client's connection after each response, for clients which misuse keep-alives
+	ConnectionClose bool
+	// HSTS, when set, is the Strict-Transport-Security header for responses over HTTPS
+	HSTS string
+	// AccessLogSample is the fraction of successful requests written to the access log, all of them when it's nil
+	AccessLogSample *float64
+	// Quiet turns off logging the host's requests, other than those which go wrong
+	Quiet bool
+	// NormalizePath is the host's normalize_path, if this rule sets it
+	NormalizePath string
+	// GRPC is whether the rule proxies gRPC calls
+	GRPC bool
+}
+
+// Path describes which paths the rule matches, for logging
+func (rule *Rule) Path() string {
+	if rule.Pattern != nil {
+		return rule.Prefix + "~" + rule.Pattern.String()
+	}
+	return rule.Prefix + "*"
+}
+
+// Matches says whether this rule is the one for the request's path
+func (rule *Rule) Matches(path string) bool {
+	if !strings.HasPrefix(path, rule.Prefix) {
+		return false
+	}
+	if rule.Paths != nil && !rule.Paths[path] {
+		return false
+	}
+	return rule.Pattern == nil || rule.Pattern.MatchString(path)
+}
+
+func (rule *Rule) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if rule.AccessLogSample != nil {
+		if statusWriter := findStatusWriter(writer); statusWriter != nil {
+			statusWriter.sample = rule.AccessLogSample
+		}
+	}
+	rule.Timeouts.apply(writer, request)
+	if rule.ConnectionClose {
+		writer = &finalHeaderWriter{ResponseWriter: writer, header: func(header http.Header) {
+			header.Set("Connection", "close")
+		}}
+	}
+	// browsers ignore HSTS over plain HTTP, and it replaces any the handler (or upstream) set
+	if rule.HSTS != "" && request.TLS != nil {
+		writer = &finalHeaderWriter{ResponseWriter: writer, header: func(header http.Header) {
+			header.Set("Strict-Transport-Security", rule.HSTS)
+		}}
+	}
+
+	if timeout := rule.Timeouts.requestTimeout(request); timeout > 0 {
+		ctx, cancel := context.WithTimeout(request.Context(), timeout)
+		defer cancel()
+		request = request.WithContext(ctx)
+		timeoutWriter := &timeoutWriter{ResponseWriter: writer, ctx: ctx}
+		defer timeoutWriter.finish(request)
+		writer = timeoutWriter
+	}
+
+	if rule.Compression != nil {
+		if compressor := compressWriter(writer, request, *rule.Compression); compressor != nil {
+			defer compressor.Close()
+			writer = compressor
+		}
+	}
+
+	if rule.BodyLogging != nil {
+		var done func()
+		writer, request, done = rule.BodyLogging.wrap(writer, request)
+		defer done()
+	}
+
+	if rule.Defaults {
+		serveWithDefaults(rule.Handler, writer, request)
+		return
+	}
+	rule.Handler.ServeHTTP(writer, request)
+}
+
+// RuleSet is every host's rules in the order they were loaded, which is the order they're tried in. Hash is of the
+// config they were loaded from, so a reload can tell whether anything has changed.
+type RuleSet struct {
+	Hosts map[string][]*Rule
+	Hash  string
+	// Quiet are the hosts with "log = off", whose requests aren't logged unless they go wrong
+	Quiet map[string]bool
+	// NormalizePath is each host's normalize_path, if it's set
+	NormalizePath map[string]string
+	// GRPC is whether any rule proxies gRPC calls, which need HTTP/2 without TLS taking from clients
+	GRPC bool
+}
+
+// rules holds the RuleSet in use, which is swapped whole when the config is reloaded
+var rules atomic.Pointer[RuleSet]
+
+// factory to create a notFound handler
+func newNotFound() *NotFound {
+	return &NotFound{
 		Handler: http.NotFoundHandler(),
 	}
 }
 
-// factory to create and add a redirect handler
-func addRedirect(from, to string) {
-	log.Println("Adding from/to:", from, to)
-	redirect[from] = Redirect{
-		To: to,
+// factory to create a handler for individual files
+func newFiles(files map[string]string) (*Files, error) {
+	for path, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("%v for %v is a directory", file, path)
+		}
+	}
+	return &Files{
+		Files: files,
+	}, nil
+}
+
+// factory to create a redirect handler
+func newRedirect(to, scheme string) *Redirect {
+	if scheme == "http" || scheme == "https" {
+		to = withScheme(to, scheme)
 	}
+	return &Redirect{
+		To:     to,
+		Scheme: scheme,
+	}
+}
+
+// ProxyOptions are the optional extras for a Proxy, read from its config file.
+type ProxyOptions struct {
+	// RequestHeaders are set on requests to the upstream, ResponseHeaders on responses to the client, after deleting
+	// the RemoveHeaders from them
+	RequestHeaders  []HeaderTemplate
+	ResponseHeaders []HeaderTemplate
+	RemoveHeaders   []string
+	// Replacements are made to the body of HTML responses
+	Replacements []Replacement
+	// RewriteLocation points redirects to the upstream back at the client's host
+	RewriteLocation bool
+	// Cookies rewrites the attributes of the upstream's cookies
+	Cookies CookieRewrite
+	// GetBody is what's done with a GET or HEAD which has a body
+	GetBody string
+	// StatusMap changes the upstream's statuses, from each key to its value
+	StatusMap map[int]int
+	// OptionsAllow, if set, answers OPTIONS requests with it as the Allow header
+	OptionsAllow string
+	// HeaderLimit, if set, caps the headers of the upstream's responses
+	HeaderLimit *HeaderLimit
+	// Idempotency, if set, replays the response to a request with an Idempotency-Key already seen, and is shared
+	// by every Proxy made with the options, so a Split's variants have the one set of keys
+	Idempotency *Idempotency
+	// Mirror, if set, gets a copy of every request, and is shared by every Proxy made with the options
+	Mirror *Mirror
+	// AccelHeader, when the upstream sets it (e.g. "X-Accel-Redirect: /file.zip"), serves that file from AccelRoot
+	// in place of the upstream's response
+	AccelHeader string
+	AccelRoot   string
+	// UpstreamTime adds an X-Upstream-Time header saying how long the upstream took to respond
+	UpstreamTime bool
+	// DropInformational keeps the upstream's 1xx responses, such as 103 Early Hints, from the client, which otherwise
+	// gets them ahead of its response
+	DropInformational bool
+	// GRPC talks HTTP/2 to the upstream and passes each message on as soon as it arrives
+	GRPC bool
+	// Transport tunes the connections to the upstream
+	Transport TransportOptions
+	// ForwardedStyle is which forwarding headers are sent, one of the forwardedStyles
+	ForwardedStyle string
+	// Template is set when "to" is filled in from the path, see TargetTemplate
+	Template *TargetTemplate
 }
 
-// factory to create a reverse proxy and add to the proxy struct
-func addProxy(host, to string) {
-	u, err := url.Parse(to)
+// factory to create a reverse proxy
+func newProxy(to string, options ProxyOptions) (*Proxy, error) {
+	// a template's {name}s aren't allowed in a URL, and only its scheme matters here
+	u, err := url.Parse(placeholder.ReplaceAllString(to, "1"))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	myProxy := httputil.NewSingleHostReverseProxy(u)
-	proxy[host] = Proxy{
-		To:           to,
-		ReverseProxy: myProxy,
+	myProxy.ErrorHandler = proxyError
+	if options.GRPC {
+		options.Transport.GRPC = true
+		myProxy.FlushInterval = -1
+	}
+	transport := newTransport(u, options.Transport)
+	myProxy.Transport = transport
+	if options.UpstreamTime {
+		myProxy.Transport = &TimingTransport{transport}
+	}
+	director := myProxy.Director
+	myProxy.Director = func(request *http.Request) {
+		inbound := inboundRequest(request)
+		// resolve against the inbound request before the director rewrites the URL
+		header := http.Header{}
+		setHeaders(header, options.RequestHeaders, inbound)
+		if target := targetOf(request); target != nil {
+			target.direct(request)
+		} else {
+			director(request)
+		}
+		setForwardingHeaders(request, inbound, options.ForwardedStyle)
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		if options.GetBody == "strip" && hasGetBody(request) {
+			debugf("Stripped Body(%v) %v %v\n", inbound.Host, request.Method, logURI(inbound))
+			request.Body = nil
+			request.ContentLength = 0
+			request.TransferEncoding = nil
+			request.Header.Del("Content-Length")
+			request.Header.Del("Content-Type")
+		}
+		allowHeaders(request.Header)
+		if settings.HeaderAllowlist != nil && !settings.HeaderAllowlist["X-Forwarded-For"] {
+			// or the ReverseProxy adds it afterwards
+			request.Header["X-Forwarded-For"] = nil
+		}
+	}
+
+	// each of these gets a go at the upstream's response, in order
+	var modifiers []func(*http.Response) error
+	if len(options.StatusMap) > 0 {
+		modifiers = append(modifiers, func(response *http.Response) error {
+			mapStatus(response, options.StatusMap)
+			return nil
+		})
 	}
+	if options.AccelHeader != "" {
+		modifiers = append(modifiers, func(response *http.Response) error {
+			return checkAccelRedirect(response, options.AccelHeader)
+		})
+		myProxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, err error) {
+			if accel, ok := err.(*AccelRedirect); ok {
+				accel.Serve(writer, request, options.AccelRoot)
+				return
+			}
+			proxyError(writer, request, err)
+		}
+	}
+	if options.RewriteLocation {
+		modifiers = append(modifiers, func(response *http.Response) error {
+			upstream := u
+			if target := targetOf(response.Request); target != nil {
+				upstream = target.Upstream
+			}
+			rewriteLocation(response, upstream)
+			return nil
+		})
+	}
+	if !options.Cookies.isEmpty() {
+		modifiers = append(modifiers, func(response *http.Response) error {
+			rewriteCookies(response, options.Cookies)
+			return nil
+		})
+	}
+	if len(options.RemoveHeaders) > 0 || len(options.ResponseHeaders) > 0 {
+		modifiers = append(modifiers, func(response *http.Response) error {
+			editResponseHeaders(response.Header, options.RemoveHeaders, options.ResponseHeaders,
+				inboundRequest(response.Request))
+			return nil
+		})
+	}
+	if options.HeaderLimit != nil {
+		modifiers = append(modifiers, options.HeaderLimit.check)
+	}
+	if len(options.Replacements) > 0 {
+		modifiers = append(modifiers, func(response *http.Response) error {
+			return replaceBody(response, options.Replacements)
+		})
+	}
+	// last, so nothing above can put back what shouldn't go to the client; a 101's Connection and Upgrade are how
+	// it switches protocol
+	modifiers = append(modifiers, func(response *http.Response) error {
+		if response.StatusCode != http.StatusSwitchingProtocols {
+			removeHopByHop(response.Header)
+			allowHeaders(response.Header)
+		}
+		return nil
+	})
+	myProxy.ModifyResponse = func(response *http.Response) error {
+		for _, modify := range modifiers {
+			if err := modify(response); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return &Proxy{
+		To:                to,
+		ReverseProxy:      myProxy,
+		Template:          options.Template,
+		DropInformational: options.DropInformational,
+		OptionsAllow:      options.OptionsAllow,
+		GetBody:           options.GetBody,
+		Idempotency:       options.Idempotency,
+		Mirror:            options.Mirror,
+	}, nil
 }
 
-// factory to create static site
-func addStatic(host, dir string) {
-	static[host] = Static{
+// factory to create static site, which is usable even when the error says dir isn't (yet) a directory
+func newStatic(dir string) (*Static, error) {
+	info, err := os.Stat(dir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%v is not a directory", dir)
+	}
+
+	return &Static{
 		Dir:     dir,
 		Handler: http.FileServer(http.Dir(dir)),
-	}
+	}, err
 }
 
 func Handler(writer http.ResponseWriter, request *http.Request) {
@@ -115,37 +807,61 @@ func Handler(writer http.ResponseWriter, request *http.Request) {
 	// log.Println("host=", request.Host)
 	// log.Println("requestURI=", request.RequestURI)
 
-	thisRedirect, ok := redirect[request.Host]
-	if ok {
-		// log.Println("Found a redirect for " + request.Host)
-		thisRedirect.ServeHTTP(writer, request)
+	if draining.Load() {
+		serveDrainPage(writer, request)
 		return
 	}
 
-	thisProxy, ok := proxy[request.Host]
-	if ok {
-		// log.Println("Found a proxy for " + request.Host)
-		thisProxy.ServeHTTP(writer, request)
+	// only HTTP/1.0 clients can leave out the Host, which would otherwise be taken as an unknown host
+	if request.Host == "" {
+		if settings.RequireHost {
+			log.Printf("Missing Host(%v) %v\n", request.RemoteAddr, logURI(request))
+			http.Error(writer, "Bad Request: missing Host header", http.StatusBadRequest)
+			return
+		}
+		request.Host = settings.DefaultHost
+	}
+
+	// as http.Server leaves it to the ServeMux we don't use
+	if request.RequestURI == "*" {
+		if request.ProtoAtLeast(1, 1) {
+			writer.Header().Set("Connection", "close")
+		}
+		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	thisNotFound, ok := notFound[request.Host]
-	if ok {
-		// log.Println("Found a NotFound for " + request.Host)
-		thisNotFound.ServeHTTP(writer, request)
+	ruleSet := rules.Load()
+	hostRules, ok := ruleSet.Hosts[request.Host]
+	if !ok {
+		// the edge's own liveness, for checks which don't send the Host of a site
+		if unknownHostRoot != nil && request.URL.Path == "/" &&
+			(request.Method == http.MethodGet || request.Method == http.MethodHead) {
+			unknownHostRoot.ServeHTTP(writer, request)
+			return
+		}
+		// since we haven't found a host in any of our data, just serve a NotFound
+		log.Printf("Host Not Found(%v)\n", request.Host)
+		unknownHostNotFound.ServeHTTP(writer, request)
 		return
 	}
 
-	thisStatic, ok := static[request.Host]
-	if ok {
-		// log.Println("Found a Static for " + request.Host)
-		thisStatic.ServeHTTP(writer, request)
+	path, ok := normalizePath(writer, request, ruleSet.NormalizePath[request.Host])
+	if !ok {
 		return
 	}
 
-	// since we haven't found a host in any of our data, just serve a NotFound
-	log.Printf("Host Not Found(%v)\n", request.Host)
-	genericNotFound.ServeHTTP(writer, request)
+	// the first rule which matches is the one which serves the request
+	for _, rule := range hostRules {
+		if rule.Matches(path) {
+			rule.ServeHTTP(writer, request)
+			return
+		}
+	}
+
+	// none of this host's rules cover this path
+	log.Printf("Path Not Found(%v) %v\n", request.Host, logURI(request))
+	serveWithDefaults(genericNotFound, writer, request)
 }
 
 func checkErr(err error) {
@@ -155,61 +871,221 @@ func checkErr(err error) {
 }
 
 func main() {
-	// make the various backend maps
-	proxy = make(map[string]Proxy)
-	notFound = make(map[string]NotFound)
-	redirect = make(map[string]Redirect)
-	static = make(map[string]Static)
-
-	// read all files in the config directory
-	files, _ := ioutil.ReadDir(configDir)
-	for _, f := range files {
-		log.Println("Loading", f.Name())
-		cfg, err := goconfig.LoadConfigFile(configDir + "/" + f.Name())
-		checkErr(err)
-		host, err := cfg.GetValue("DEFAULT", "host")
-		if err != nil {
-			log.Fatal(err)
+	check := flag.Bool("check", false, "check the config, report any problems and exit")
+	probe := flag.Bool("test-backends", false, "make a request to every Proxy backend, report which are up and exit")
+	flag.Var(&configDirs, "config-dir", "the `directories` of rules, comma separated or given more than once, later ones' hosts replacing earlier ones'")
+	flag.StringVar(&configFile, "config-file", "", "a file of rules, one per section, to load along with the last -config-dir")
+	flag.Parse()
+
+	// gather up every problem in the config so they can all be fixed in one go
+	errs := loadSettings()
+	setupLogging()
+	if settings.DefaultRobots != "" {
+		defaultFiles["/robots.txt"] = settings.DefaultRobots
+	}
+	if settings.DefaultFavicon != "" {
+		defaultFiles["/favicon.ico"] = settings.DefaultFavicon
+	}
+
+	switch {
+	case settings.UnknownHostStatus == 444:
+		unknownHostNotFound = http.HandlerFunc(closeConnection)
+	case settings.DefaultNotFoundPage != nil || settings.UnknownHostStatus != http.StatusNotFound:
+		unknownHostNotFound = &NotFoundPage{Page: settings.DefaultNotFoundPage, Status: settings.UnknownHostStatus}
+	}
+	if settings.UnknownHostRoot != "" {
+		unknownHostRoot = &Respond{Status: http.StatusOK, ContentType: "text/plain; charset=utf-8",
+			Body: []byte(settings.UnknownHostRoot + "\n")}
+	}
+
+	loadedAt.Store(time.Now().UnixNano())
+	ruleSet, ruleErrs := loadRules(configDirs)
+	errs = append(errs, ruleErrs...)
+	if settings.CertDir != "" {
+		certs, certErrs := loadCertificates(settings.CertDir, settings.DefaultCert)
+		errs = append(errs, certErrs...)
+		certificates.Store(certs)
+	}
+	if len(errs) > 0 {
+		log.Printf("Found %d problem(s) in the config:\n", len(errs))
+		for _, err := range errs {
+			log.Println("  ", err)
 		}
-		log.Println("host=", host)
+		os.Exit(1)
+	}
+	rules.Store(ruleSet)
 
-		typ, err := cfg.GetValue("DEFAULT", "type")
-		if err != nil {
-			log.Fatal(err)
+	if *check {
+		log.Println("Config OK")
+		logSummary(ruleSet)
+		return
+	}
+	if *probe {
+		if !testBackends(ruleSet, 10*time.Second) {
+			os.Exit(1)
 		}
-		log.Println("type=", typ)
+		return
+	}
+
+	logSummary(ruleSet)
+	go reloadOnSignal()
+	if settings.StaleCheckInterval > 0 {
+		go warnIfStale(settings.StaleCheckInterval)
+	}
+
+	// all setting up of sites done, let's start the server
+	log.Println("Starting Server")
+
+	// not a ServeMux, which would redirect every unclean path whatever normalize_path says
+	var handler http.Handler = http.HandlerFunc(Handler)
+	if settings.AccessLog != "" {
+		var err error
+		accessLog, err = openAccessLog(settings.AccessLog, settings.AccessLogCompress)
+		checkErr(err)
+		log.Println("Access log is", settings.AccessLog)
+		handler = accessLogged(handler)
+		go reopenAccessLogOnSignal()
+	}
 
-		// depending on the type add it to the right map
-		if typ == "NotFound" {
-			addNotFound(host)
+	if settings.MaxHeaderBytes <= 0 {
+		settings.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	log.Printf("Max header bytes is %d (higher allows big URLs and cookies, lower limits abuse)\n", settings.MaxHeaderBytes)
+	server := &http.Server{
+		Handler:        handler,
+		ReadTimeout:    settings.ReadTimeout,
+		WriteTimeout:   settings.WriteTimeout,
+		MaxHeaderBytes: settings.MaxHeaderBytes,
+		Protocols:      new(http.Protocols),
+		ErrorLog:       newServerErrorLog(),
+	}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	// HTTP/2 without TLS is only spoken to clients which start with it, as gRPC clients do, so it's left off
+	// unless there's something for them
+	if ruleSet.GRPC {
+		log.Println("Taking HTTP/2 without TLS (h2c), for gRPC")
+		server.Protocols.SetUnencryptedHTTP2(true)
+		unencryptedHTTP2 = true
+	}
+	if !settings.KeepAlive {
+		log.Println("Keep-alives are off")
+		server.SetKeepAlivesEnabled(false)
+	}
+
+	// when taking over from an upgrade the sockets are already open, and the upstreams already up
+	listeners, tlsListener, err := inheritedListeners()
+	checkErr(err)
+	upgrading := len(listeners) > 0
+	if upgrading {
+		log.Println("Taking over", len(listeners), "socket(s) from pid", os.Getppid())
+	}
+
+	// hold off listening until the upstreams should be ready for us
+	if settings.StartupDelay > 0 && !upgrading {
+		log.Println("Waiting", settings.StartupDelay, "before listening")
+		time.Sleep(settings.StartupDelay)
+	}
+	if settings.WaitForUpstreams > 0 && !upgrading {
+		waitForUpstreams(ruleSet, settings.WaitForUpstreams)
+	}
+
+	// use the sockets systemd has opened for us, otherwise bind our own
+	if !upgrading {
+		listeners, tlsListener, err = activatedListeners()
+		checkErr(err)
+		if tlsListener != nil && settings.CertDir == "" {
+			// there's nothing to serve it with, and plain HTTP is no use to the clients on it
+			log.Println("Error: not serving systemd's https socket, as there's no cert_dir")
+			listeners = slices.DeleteFunc(listeners, func(listener net.Listener) bool { return listener == tlsListener })
+			tlsListener.Close()
+			tlsListener = nil
 		}
-		if typ == "Proxy" {
-			to, err := cfg.GetValue("DEFAULT", "to")
+		if len(listeners) > 0 {
+			log.Println("Using", len(listeners), "socket(s) from systemd")
+		} else {
+			listener, err := listen("localhost:80")
 			checkErr(err)
-			log.Println("to=", to)
-			addProxy(host, to)
+			listeners = append(listeners, listener)
 		}
-		if typ == "Static" {
-			dir, err := cfg.GetValue("DEFAULT", "dir")
-			checkErr(err)
-			log.Println("dir=", dir)
-			addStatic(host, dir)
+		if settings.CertDir != "" && tlsListener == nil {
+			tlsListener, err = listen(settings.TLSAddress)
+			if err != nil && !settings.TLSCritical {
+				// the rest can carry on without HTTPS
+				log.Println("Error: not serving HTTPS:", err)
+			} else {
+				checkErr(err)
+				listeners = append(listeners, tlsListener)
+			}
 		}
-		if typ == "Redirect" {
-			to, err := cfg.GetValue("DEFAULT", "to")
-			checkErr(err)
-			log.Println("to=", to)
-			addRedirect(host, to)
+	}
+
+	// now we have our sockets, we no longer need to be root
+	if settings.User != "" {
+		checkErr(dropPrivileges(settings.User, settings.Group))
+	}
+
+	var connLimit chan struct{}
+	if settings.MaxConnections > 0 {
+		log.Println("Limiting connections to", settings.MaxConnections)
+		connLimit = newConnLimit(settings.MaxConnections)
+	}
+	if settings.MaxConnsPerIP > 0 {
+		log.Println("Limiting connections per IP to", settings.MaxConnsPerIP)
+	}
+	var handover *handover
+	if settings.GracefulUpgrade {
+		handover = newHandover(tlsListener)
+		server.ConnState = handover.connState
+	}
+	serveErrs := make(chan error)
+	for _, listener := range listeners {
+		isTLS := listener == tlsListener
+		if handover != nil {
+			listener = handover.wrap(listener)
 		}
+		if settings.MaxConnsPerIP > 0 {
+			perIP := NewPerIPLimitListener(listener, settings.MaxConnsPerIP)
+			perIP.TLS = isTLS
+			listener = perIP
+		}
+		if connLimit != nil {
+			listener = NewLimitListener(listener, connLimit)
+		}
+		// TLS goes on last, as the server needs to see the *tls.Conn itself
+		if isTLS {
+			listener = tls.NewListener(listener, tlsConfig())
+		}
+		log.Println("Listening on", listener.Addr())
+		go func(listener net.Listener) {
+			serveErrs <- server.Serve(listener)
+		}(listener)
 	}
 
-	// all setting up of sites done, let's start the server
-	log.Println("Starting Server")
+	if upgrading {
+		upgraded()
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", Handler)
+	shutdown := make(chan struct{})
+	shutdownOnce := sync.OnceFunc(func() { close(shutdown) })
+	if settings.DrainPeriod > 0 {
+		go drainOnSignal(server, shutdownOnce)
+	} else if accessLog != nil {
+		go closeAccessLogOnSignal()
+	}
+	if handover != nil {
+		go upgradeOnSignal(server, handover, shutdownOnce)
+	}
 
-	err := http.ListenAndServe("localhost:80", mux)
+	err = <-serveErrs
+	if err == http.ErrServerClosed {
+		<-shutdown
+		if accessLog != nil {
+			checkErr(accessLog.Close())
+		}
+		log.Println("Shutdown complete")
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// dispatchf and the rest look the host up in the rules in use
+	rules.Store(&RuleSet{Hosts: map[string][]*Rule{}, Quiet: map[string]bool{}})
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// testProxy makes a Proxy to the server's URL with the options any Proxy entry gets by default
+func testProxy(t *testing.T, upstream *httptest.Server, options ProxyOptions) *Proxy {
+	t.Helper()
+	options.RewriteLocation = true
+	if options.ForwardedStyle == "" {
+		options.ForwardedStyle = "x-forwarded"
+	}
+	proxy, err := newProxy(upstream.URL, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+// loadTestRules writes each of the files into a config dir of their own and loads the rules from it
+func loadTestRules(t *testing.T, files map[string]string) (*RuleSet, []error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return loadRules([]string{dir})
+}
+
+// withSettings has the settings changed for the rest of the test, by the given function
+func withSettings(t *testing.T, change func(*Settings)) {
+	saved := settings
+	change(&settings)
+	t.Cleanup(func() { settings = saved })
+}
+
+// withRules has requests served by the given rules for the rest of the test, each host having just the one handler
+func withRules(t *testing.T, hosts map[string]http.Handler) {
+	ruleSet := &RuleSet{Hosts: map[string][]*Rule{}, Quiet: map[string]bool{}}
+	for host, handler := range hosts {
+		ruleSet.Hosts[host] = []*Rule{{Type: "Test", Handler: handler}}
+	}
+	saved := rules.Swap(ruleSet)
+	t.Cleanup(func() { rules.Store(saved) })
+}
+
+// rawResponse sends the request exactly as it's given and reads the response to it
+func rawResponse(t *testing.T, server *httptest.Server, request string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, request)
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}